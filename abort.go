@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// outcomeClientAborted is the outcome of requests whose client went away, such
+// as by timing out, before they were fully responded to.
+const outcomeClientAborted = "client_aborted"
+
+// sleepRequest waits d, or until the client of r goes away, and returns
+// whether it waited d. If the client went away, the time it did is recorded in
+// the details of r and the request should be given up.
+func sleepRequest(r *http.Request, d time.Duration) bool {
+	ctx := r.Context()
+	if ctx.Err() == nil && d <= 0 {
+		return true
+	}
+
+	if ctx.Err() == nil {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-ctx.Done():
+		}
+	}
+
+	detailsFromRequest(r).setAborted(time.Now())
+	return false
+}
+
+// checkAborted returns whether the client of r went away, recording when in
+// the details of r if it did.
+func checkAborted(r *http.Request) bool {
+	if r.Context().Err() == nil {
+		return false
+	}
+	detailsFromRequest(r).setAborted(time.Now())
+	return true
+}
+
+// checkBodyAborted returns whether err, from reading the body of r, is because
+// the client of r went away, recording when in the details of r if it did.
+// Over HTTP/1.x, the context of a request is only canceled once its body has
+// been read, so a client going away while sending it is told by the body
+// ending early.
+func checkBodyAborted(r *http.Request, err error) bool {
+	if err == io.ErrUnexpectedEOF {
+		detailsFromRequest(r).setAborted(time.Now())
+		return true
+	}
+	return checkAborted(r)
+}
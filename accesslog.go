@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type AccessLogFormat string
+
+const (
+	// the request ID, method, path, remote address and user agent, through
+	// the logger of the server
+	AccessLogFormatText AccessLogFormat = "TEXT"
+
+	// one JSON object per line
+	AccessLogFormatJSON AccessLogFormat = "JSON"
+
+	// one line of key=value pairs
+	AccessLogFormatLogfmt AccessLogFormat = "LOGFMT"
+)
+
+// AccessLog describes the access log of a server.
+type AccessLog struct {
+	Format AccessLogFormat
+
+	// where entries are written; nil for standard output
+	Output io.Writer
+
+	// fraction of requests logged
+	SampleRate float64
+}
+
+type accessLogParameters struct {
+	Format     string  `json:"format"`
+	Path       *string `json:"path,omitempty"`
+	SampleRate float64 `json:"sample_rate"`
+}
+
+// buildAccessLog builds the access log of the server described by v, opening
+// its destination file if it has one.
+func buildAccessLog(v *viper.Viper) (*AccessLog, *accessLogParameters, error) {
+	accessLog := &AccessLog{
+		Format:     AccessLogFormat(strings.ToUpper(v.GetString("access-log.format"))),
+		SampleRate: v.GetFloat64("access-log.sample-rate"),
+	}
+
+	switch accessLog.Format {
+	case AccessLogFormatText, AccessLogFormatJSON, AccessLogFormatLogfmt:
+	default:
+		return nil, nil, fmt.Errorf("unknown access-log-format value: %s", accessLog.Format)
+	}
+	if accessLog.SampleRate < 0 || accessLog.SampleRate > 1 {
+		return nil, nil, fmt.Errorf("--access-log-sample-rate must be between 0 and 1, got: %v", accessLog.SampleRate)
+	}
+
+	parameters := &accessLogParameters{
+		Format:     string(accessLog.Format),
+		SampleRate: accessLog.SampleRate,
+	}
+
+	if path := v.GetString("access-log.path"); path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not open access log: %s", err)
+		}
+		accessLog.Output = f
+		parameters.Path = &path
+	}
+
+	return accessLog, parameters, nil
+}
+
+// requestDetails collects what the middlewares did to a request, such as the
+// faults they injected, for its access log entry.
+type requestDetails struct {
+	route string
+
+	latency *time.Duration
+
+	rateLimit string
+	queueWait time.Duration
+
+	errorResult string
+
+	bytes    int
+	messages int
+
+	// when the client went away, if it did before the request was responded
+	// to
+	abortedAt *time.Time
+}
+
+// detailsFromRequest returns the details collected for r, or nil if they are
+// not. The methods of requestDetails do nothing on nil.
+func detailsFromRequest(r *http.Request) *requestDetails {
+	d, _ := r.Context().Value(requestDetailsKey).(*requestDetails)
+	return d
+}
+
+func (d *requestDetails) setRoute(route string) {
+	if d != nil {
+		d.route = route
+	}
+}
+
+func (d *requestDetails) setLatency(latency time.Duration) {
+	if d != nil {
+		d.latency = &latency
+	}
+}
+
+// setRateLimit records the decision of the rate limiter: allowed, limited or
+// queued for wait.
+func (d *requestDetails) setRateLimit(decision string, wait time.Duration) {
+	if d != nil {
+		d.rateLimit = decision
+		d.queueWait = wait
+	}
+}
+
+func (d *requestDetails) setErrorResult(result string) {
+	if d != nil {
+		d.errorResult = result
+	}
+}
+
+func (d *requestDetails) setBody(bytes, messages int) {
+	if d != nil {
+		d.bytes = bytes
+		d.messages = messages
+	}
+}
+
+// setAborted records that the client went away at t, unless it was already
+// recorded.
+func (d *requestDetails) setAborted(t time.Time) {
+	if d != nil && d.abortedAt == nil {
+		d.abortedAt = &t
+	}
+}
+
+// accessLog writes an entry for each request served, or a sample of them.
+type accessLog struct {
+	options AccessLog
+	name    string
+	logger  *log.Logger
+
+	mu     sync.Mutex
+	output io.Writer
+}
+
+func newAccessLog(options AccessLog, name string, logger *log.Logger) *accessLog {
+	if options.Format == "" {
+		options.Format = AccessLogFormatText
+		options.SampleRate = 1
+	}
+
+	al := &accessLog{
+		options: options,
+		name:    name,
+		logger:  logger,
+		output:  options.Output,
+	}
+	if options.Format == AccessLogFormatText && options.Output != nil {
+		al.logger = log.New(options.Output, logger.Prefix(), logger.Flags())
+	}
+	if al.output == nil {
+		al.output = os.Stdout
+	}
+	return al
+}
+
+func (al *accessLog) WrapHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		details := &requestDetails{}
+		wrapper := &responseWriterWrapper{ResponseWriter: rw}
+
+		defer func() {
+			if al.options.SampleRate < 1 && rand.Float64() >= al.options.SampleRate {
+				return
+			}
+			al.write(r, wrapper, details, start)
+		}()
+
+		next.ServeHTTP(wrapper, r.WithContext(context.WithValue(r.Context(), requestDetailsKey, details)))
+	})
+}
+
+// write writes the access log entry of r.
+func (al *accessLog) write(r *http.Request, rw *responseWriterWrapper, details *requestDetails, start time.Time) {
+	requestID := requestID(r)
+	if requestID == "" {
+		requestID = "unknown"
+	}
+
+	if al.options.Format == AccessLogFormatText {
+		al.logger.Println(requestID, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
+		return
+	}
+
+	// responses written without an explicit status are a 200, and requests
+	// whose connection was closed or stream reset have none
+	status := rw.status
+	if status == 0 && rw.written > 0 {
+		status = http.StatusOK
+	}
+
+	entry := accessLogEntry{}
+	entry.add("time", start.UTC().Format(time.RFC3339Nano))
+	if al.name != "" {
+		entry.add("server", al.name)
+	}
+	entry.add("request_id", requestID)
+	if tc := requestTraceContext(r); tc != nil {
+		entry.add("trace_id", tc.TraceID)
+	}
+	entry.add("method", r.Method)
+	entry.add("path", r.URL.Path)
+	if details.route != "" {
+		entry.add("route", details.route)
+	}
+	entry.add("remote_addr", r.RemoteAddr)
+	entry.add("user_agent", r.UserAgent())
+	entry.add("proto", r.Proto)
+	entry.add("status", status)
+	entry.add("duration_ms", durationMs(time.Since(start)))
+	entry.add("bytes", details.bytes)
+	entry.add("messages", details.messages)
+	entry.add("response_bytes", rw.written)
+	if details.latency != nil {
+		entry.add("latency_ms", durationMs(*details.latency))
+	}
+	if details.rateLimit != "" {
+		entry.add("rate_limit", details.rateLimit)
+		if details.queueWait > 0 {
+			entry.add("queue_wait_ms", durationMs(details.queueWait))
+		}
+	}
+	if details.errorResult != "" {
+		entry.add("error", details.errorResult)
+	}
+	if details.abortedAt != nil {
+		entry.add("outcome", outcomeClientAborted)
+		entry.add("aborted_after_ms", durationMs(details.abortedAt.Sub(start)))
+	}
+
+	var b []byte
+	if al.options.Format == AccessLogFormatJSON {
+		b = entry.JSON()
+	} else {
+		b = entry.Logfmt()
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	al.output.Write(append(b, '\n'))
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// accessLogEntry is the fields of an access log entry, in order.
+type accessLogEntry struct {
+	keys   []string
+	values []interface{}
+}
+
+func (e *accessLogEntry) add(key string, value interface{}) {
+	e.keys = append(e.keys, key)
+	e.values = append(e.values, value)
+}
+
+func (e *accessLogEntry) JSON() []byte {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, key := range e.keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(e.values[i])
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(e.values[i]))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+	return b.Bytes()
+}
+
+func (e *accessLogEntry) Logfmt() []byte {
+	var b bytes.Buffer
+	for i, key := range e.keys {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+
+		var v string
+		switch value := e.values[i].(type) {
+		case string:
+			v = value
+		case float64:
+			v = strconv.FormatFloat(value, 'f', -1, 64)
+		default:
+			v = fmt.Sprint(value)
+		}
+		if v == "" || strings.ContainsAny(v, " \"=\\") || strings.IndexFunc(v, func(r rune) bool { return r < ' ' }) >= 0 {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(v)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const adminPathPrefix = "/_admin"
+
+// adminSections are the sections of a profile that can be replaced at
+// runtime through the admin API.
+var adminSections = map[string]bool{
+	"latency":    true,
+	"error":      true,
+	"rate-limit": true,
+}
+
+type adminConfig struct {
+	Routes map[string]map[string]interface{} `json:"routes"`
+}
+
+// Admin serves the admin API used to inspect and change the behavior of the
+// routes of the server at runtime:
+//
+//	GET /_admin/config             returns the current settings of every route
+//	PUT /_admin/config?route=PATH  replaces the latency, error and/or rate-limit
+//	                               sections of the route at PATH (default /)
+func (s *Server) Admin(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != adminPathPrefix+"/config" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		path := r.URL.Query().Get("route")
+		if path == "" {
+			path = "/"
+		}
+
+		route := s.route(path)
+		if route == nil {
+			http.Error(w, fmt.Sprintf("no route mounted at %s", path), http.StatusNotFound)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not read body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		update := map[string]interface{}{}
+		if err := json.Unmarshal(body, &update); err != nil {
+			http.Error(w, fmt.Sprintf("could not parse body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := s.reconfigure(route, update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := adminConfig{
+		Routes: map[string]map[string]interface{}{},
+	}
+	for _, route := range s.routes {
+		config.Routes[route.path] = route.Settings()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+func (s *Server) route(path string) *mountedRoute {
+	for _, route := range s.routes {
+		if route.path == path {
+			return route
+		}
+	}
+	return nil
+}
+
+// reconfigure replaces the sections of the settings of route given in update
+// and swaps in the rebuilt pipeline, which keeps the time and rate limit
+// tokens of the current one. The current pipeline is kept if the resulting
+// settings are invalid.
+func (s *Server) reconfigure(route *mountedRoute, update map[string]interface{}) error {
+	settings := map[string]interface{}{}
+	for key, value := range route.Settings() {
+		settings[key] = value
+	}
+	for key, value := range update {
+		key = strings.ToLower(key)
+		if !adminSections[key] {
+			return fmt.Errorf("unknown section: %s; expected one of [latency, error, rate-limit]", key)
+		}
+		settings[key] = value
+	}
+
+	profile, err := buildProfile(newProfileViper(settings))
+	if err != nil {
+		return err
+	}
+
+	serverOptions := resolveOptions(profile.options)
+	route.reconfigure(s.buildPipeline(serverOptions), serverOptions.RateLimiter, serverOptions.Settings)
+	s.recordEvent(&Event{Time: time.Now().UTC(), Type: EventReconfigure, Route: route.path, Name: "admin"})
+	s.logger.Printf("Route %s reconfigured through the admin API", route.path)
+
+	return nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type ConnectionLimitBehavior string
+
+const (
+	// stops accepting connections, leaving them in the kernel backlog
+	ConnectionLimitBehaviorStop ConnectionLimitBehavior = "STOP"
+
+	// accepts connections and closes them immediately
+	ConnectionLimitBehaviorClose ConnectionLimitBehavior = "CLOSE"
+
+	// accepts connections and holds them, without reading from them, until
+	// there is available capacity
+	ConnectionLimitBehaviorHold ConnectionLimitBehavior = "HOLD"
+)
+
+// ConnectionLimit caps the number of connections a server serves at once.
+type ConnectionLimit struct {
+	// 0 for no limit
+	MaxConnections int
+	Behavior       ConnectionLimitBehavior
+}
+
+type connectionLimitParameters struct {
+	MaxConnections int    `json:"max_connections"`
+	Behavior       string `json:"behavior"`
+}
+
+// buildConnectionLimit builds the connection limit of the server described by
+// v, or returns nil if there is none.
+func buildConnectionLimit(v *viper.Viper) (*ConnectionLimit, *connectionLimitParameters, error) {
+	max := v.GetInt("connection.limit.max")
+	if max < 0 {
+		return nil, nil, fmt.Errorf("--connection-limit-max must be >= 0, got: %d", max)
+	}
+	if max == 0 {
+		return nil, nil, nil
+	}
+
+	behavior := ConnectionLimitBehavior(v.GetString("connection.limit.behavior"))
+	switch behavior {
+	case ConnectionLimitBehaviorStop, ConnectionLimitBehaviorClose, ConnectionLimitBehaviorHold:
+	default:
+		return nil, nil, fmt.Errorf("unknown connection-limit-behavior value: %s", behavior)
+	}
+
+	return &ConnectionLimit{
+		MaxConnections: max,
+		Behavior:       behavior,
+	}, &connectionLimitParameters{
+		MaxConnections: max,
+		Behavior:       string(behavior),
+	}, nil
+}
+
+// acquire takes a slot for a connection, waiting for one to be released if
+// wait is true. It returns false if none was taken.
+func (cs *connections) acquire(wait bool, done <-chan struct{}) bool {
+	if !wait {
+		select {
+		case cs.slots <- struct{}{}:
+			return true
+		default:
+			return false
+		}
+	}
+
+	select {
+	case cs.slots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// release returns the slot of a closed connection.
+func (cs *connections) release() {
+	if cs.slots != nil {
+		<-cs.slots
+	}
+}
+
+// admissionListener limits the number of connections served at once by the
+// server, according to the connection limit of connections.
+type admissionListener struct {
+	net.Listener
+	connections *connections
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func newAdmissionListener(listener net.Listener, connections *connections) *admissionListener {
+	l := &admissionListener{
+		Listener:    listener,
+		connections: connections,
+		conns:       make(chan net.Conn),
+		done:        make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *admissionListener) acceptLoop() {
+	cs := l.connections
+	stop := cs.limit.Behavior == ConnectionLimitBehaviorStop
+
+	for {
+		// leave connections in the backlog until there is capacity
+		if stop && !cs.acquire(true, l.done) {
+			return
+		}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if stop {
+				cs.release()
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			l.Close()
+			return
+		}
+
+		cs.mu.Lock()
+		cs.statistics.Accepted++
+		cs.mu.Unlock()
+
+		switch {
+		case stop || cs.acquire(false, nil):
+			go l.admit(conn)
+		case cs.limit.Behavior == ConnectionLimitBehaviorClose:
+			l.refuse(conn)
+		case cs.limit.Behavior == ConnectionLimitBehaviorHold:
+			go l.hold(conn)
+		}
+	}
+}
+
+func (l *admissionListener) admit(conn net.Conn) {
+	c := l.connections.track(conn)
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+// refuse closes conn as soon as it is accepted, with a TCP RST if closes are
+// abortive.
+func (l *admissionListener) refuse(conn net.Conn) {
+	cs := l.connections
+
+	cs.mu.Lock()
+	cs.statistics.Refused++
+	if tc, ok := conn.(*net.TCPConn); ok && cs.faults.AbortiveClose {
+		tc.SetLinger(0)
+		cs.statistics.Resets++
+	}
+	cs.mu.Unlock()
+
+	conn.Close()
+}
+
+// hold leaves conn unread until there is capacity to serve it.
+func (l *admissionListener) hold(conn net.Conn) {
+	cs := l.connections
+
+	cs.mu.Lock()
+	cs.statistics.Held++
+	cs.mu.Unlock()
+
+	admitted := cs.acquire(true, l.done)
+
+	cs.mu.Lock()
+	cs.statistics.Held--
+	cs.mu.Unlock()
+
+	if !admitted {
+		conn.Close()
+		return
+	}
+	l.admit(conn)
+}
+
+func (l *admissionListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, fmt.Errorf("use of closed network connection")
+	}
+}
+
+func (l *admissionListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.done)
+		err = l.Listener.Close()
+	})
+	return err
+}
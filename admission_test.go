@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestBuildConnectionLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		max      int
+		behavior string
+		want     *ConnectionLimit
+		err      bool
+	}{
+		{name: "no limit", max: 0, behavior: "CLOSE"},
+		{name: "negative max", max: -1, behavior: "CLOSE", err: true},
+		{name: "stop", max: 2, behavior: "STOP", want: &ConnectionLimit{MaxConnections: 2, Behavior: ConnectionLimitBehaviorStop}},
+		{name: "close", max: 2, behavior: "CLOSE", want: &ConnectionLimit{MaxConnections: 2, Behavior: ConnectionLimitBehaviorClose}},
+		{name: "hold", max: 2, behavior: "HOLD", want: &ConnectionLimit{MaxConnections: 2, Behavior: ConnectionLimitBehaviorHold}},
+		{name: "unknown behavior", max: 2, behavior: "DROP", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.Set("connection.limit.max", tt.max)
+			v.Set("connection.limit.behavior", tt.behavior)
+
+			limit, _, err := buildConnectionLimit(v)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error: %v", err, tt.err)
+			}
+			if tt.want == nil {
+				if limit != nil {
+					t.Fatalf("got limit %+v, want none", limit)
+				}
+				return
+			}
+			if limit == nil || *limit != *tt.want {
+				t.Fatalf("got limit %+v, want %+v", limit, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdmissionListener(t *testing.T) {
+	tests := []struct {
+		behavior ConnectionLimitBehavior
+
+		// whether the connection over the limit is closed by the server
+		refused bool
+		// the statistics once the connection over the limit is waiting
+		accepted, refusedCount, held int64
+	}{
+		{behavior: ConnectionLimitBehaviorStop, accepted: 2},
+		{behavior: ConnectionLimitBehaviorClose, refused: true, accepted: 3, refusedCount: 1},
+		{behavior: ConnectionLimitBehaviorHold, accepted: 3, held: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.behavior), func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cs := newConnections(ConnectionFaults{}, ConnectionLimit{MaxConnections: 2, Behavior: tt.behavior})
+			listener := cs.Listener(l)
+			defer listener.Close()
+
+			accepted := make(chan net.Conn, 3)
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					accepted <- conn
+				}
+			}()
+
+			var clients []net.Conn
+			for i := 0; i < 3; i++ {
+				client, err := net.Dial("tcp", l.Addr().String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer client.Close()
+				clients = append(clients, client)
+			}
+
+			var served []net.Conn
+			for i := 0; i < 2; i++ {
+				select {
+				case conn := <-accepted:
+					served = append(served, conn)
+				case <-time.After(time.Second):
+					t.Fatalf("connection %d was not admitted", i)
+				}
+			}
+
+			if tt.refused {
+				clients[2].SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := clients[2].Read(make([]byte, 1)); err == nil {
+					t.Fatal("connection over the limit was not closed")
+				}
+			}
+
+			waitFor(t, func() bool {
+				statistics := cs.Statistics()
+				return statistics.Accepted == tt.accepted && statistics.Refused == tt.refusedCount && statistics.Held == tt.held
+			})
+
+			select {
+			case <-accepted:
+				t.Fatal("connection over the limit was admitted")
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			// releasing a slot admits the connection waiting for one
+			wait := time.Second
+			if tt.refused {
+				wait = 50 * time.Millisecond
+			}
+			served[0].Close()
+			select {
+			case conn := <-accepted:
+				if tt.refused {
+					t.Fatal("refused connection was admitted")
+				}
+				conn.Close()
+			case <-time.After(wait):
+				if !tt.refused {
+					t.Fatal("connection waiting for a slot was not admitted")
+				}
+			}
+			served[1].Close()
+		})
+	}
+}
+
+// waitFor fails t if condition does not become true within a second.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 1s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -1,7 +1,7 @@
 set -euo pipefail
 
 if [ $# -ne 1 ]; then
-  echo "usage: $0 FILENAME.sh"
+  echo "usage: $0 FILENAME.sh|SCENARIO.{yaml,toml,json}"
   exit 1
 fi
 
@@ -13,12 +13,20 @@ for cmd in convert jq gnuplot ruby ; do
   fi
 done
 
-set -o allexport
-source "$1"
-set +o allexport
+case "$1" in
+  *.sh)
+    set -o allexport
+    source "$1"
+    set +o allexport
+    ;;
+  *)
+    # a scenario file read directly by the server
+    export HTTP_TEST_CONFIG="$(cd "$(dirname "$1")" && pwd)/${1##*/}"
+    ;;
+esac
 
 HTTP_TEST_NAME="${1##*/}"
-HTTP_TEST_NAME="${HTTP_TEST_NAME%.sh}"
+HTTP_TEST_NAME="${HTTP_TEST_NAME%.*}"
 
 VECTOR="${VECTOR:-vector}"
 TEST_CMD="${TEST_CMD:-"${VECTOR} -vv --config ${DIR}/concurrency/vector.toml"}"
@@ -26,6 +34,7 @@ HTTP_TEST_SERVER="${HTTP_TEST_SERVER:-${DIR}/../http_test_server}"
 OUTPUT_DIR="${OUTPUT_DIR:-$(mktemp -d -t vector-XXXXXXXXXX)}"
 TEST_TIME=${TEST_TIME:-60} # how many seconds to run test for
 HTTP_TEST_DESCRIPTION=${HTTP_TEST_DESCRIPTION:-${HTTP_TEST_NAME}}
+HTTP_TEST_EXPECTED_RATE=${HTTP_TEST_EXPECTED_RATE:-0}
 
 # See ../README.md for additional environment variables that can be set to
 # control server behavior
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cast"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration.",
+}
+
+var configDumpCmd = &cobra.Command{
+	Use:   "dump",
+	Short: "Print the effective configuration as JSON.",
+	Long: `Print the effective configuration as JSON.
+
+The configuration is resolved from flags, environment variables, the config
+file and defaults, in that order of precedence. Servers, routes and phases
+are resolved with the defaults of every option they do not set.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		settings, err := resolveSettings(viper.GetViper())
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(settings)
+	},
+}
+
+// serverKeys maps the configuration keys of a server that are nested, other
+// than its profile, to the flags that set them on the command line.
+var serverKeys = map[string]string{
+	"tls.enabled":        "tls",
+	"tls.cert-file":      "tls-cert-file",
+	"tls.key-file":       "tls-key-file",
+	"tls.client-auth":    "tls-client-auth",
+	"tls.client-ca-file": "tls-client-ca-file",
+
+	"http2.enabled":                "http2",
+	"http2.max-concurrent-streams": "http2-max-concurrent-streams",
+
+	"connection.max-requests":      "connection-max-requests",
+	"connection.close-probability": "connection-close-probability",
+	"connection.idle-kill-after":   "connection-idle-kill-after",
+	"connection.abortive-close":    "connection-abortive-close",
+	"connection.limit.max":         "connection-limit-max",
+	"connection.limit.behavior":    "connection-limit-behavior",
+
+	"proxy-protocol.enabled": "proxy-protocol",
+
+	"drain.timeout":      "drain-timeout",
+	"drain.health-delay": "drain-health-delay",
+	"drain.behavior":     "drain-behavior",
+	"drain.reject-delay": "drain-reject-delay",
+	"drain.retry-after":  "drain-retry-after",
+
+	"health.path":              "health-path",
+	"health.method":            "health-method",
+	"health.healthy-status":    "health-healthy-status",
+	"health.unhealthy-status":  "health-unhealthy-status",
+	"health.expression":        "health-expression",
+	"health.unhealthy-windows": "health-unhealthy-windows",
+	"health.flap.healthy":      "health-flap-healthy",
+	"health.flap.unhealthy":    "health-flap-unhealthy",
+	"health.liveness-path":     "health-liveness-path",
+	"health.readiness-path":    "health-readiness-path",
+	"health.readiness-delay":   "health-readiness-delay",
+
+	"access-log.format":      "access-log-format",
+	"access-log.path":        "access-log-path",
+	"access-log.sample-rate": "access-log-sample-rate",
+
+	"timeouts.read":  "read-timeout",
+	"timeouts.write": "write-timeout",
+	"timeouts.idle":  "idle-timeout",
+
+	"request-body.rate":        "request-body-rate",
+	"request-body.shared":      "request-body-shared",
+	"request-body.pause-after": "request-body-pause-after",
+	"request-body.pause":       "request-body-pause",
+}
+
+// serverDefaults holds the flag defaults of each server key once the flags
+// are bound.
+var serverDefaults = map[string]string{}
+
+// bindFlags binds each of flags to its configuration key in v: profile and
+// server flags to their nested key and any other flag to its own name.
+func bindFlags(v *viper.Viper, flags *pflag.FlagSet) {
+	profileFlags := map[string]string{}
+	for key, name := range profileKeys {
+		profileFlags[name] = key
+	}
+	serverFlags := map[string]string{}
+	for key, name := range serverKeys {
+		serverFlags[name] = key
+	}
+
+	flags.VisitAll(func(flag *pflag.Flag) {
+		key := flag.Name
+		if k, ok := profileFlags[flag.Name]; ok {
+			key = k
+			profileDefaults[key] = flag.DefValue
+		} else if k, ok := serverFlags[flag.Name]; ok {
+			key = k
+			serverDefaults[key] = flag.DefValue
+		}
+		v.BindPFlag(key, flag)
+	})
+}
+
+// newServerViper returns a configuration for a single virtual server from
+// settings, falling back to the flag defaults for anything not set.
+func newServerViper(settings map[string]interface{}) *viper.Viper {
+	v := newProfileViper(settings)
+	for key, value := range serverDefaults {
+		v.SetDefault(key, value)
+	}
+	return v
+}
+
+// loadConfig reads the scenario file given by the config key, if any, into v.
+// The format is determined by the file extension (YAML, TOML, JSON, ...).
+// Flags and environment variables take precedence over the file.
+func loadConfig(v *viper.Viper) error {
+	path := v.GetString("config")
+	if path == "" {
+		return nil
+	}
+
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("could not read config file %s: %s", path, err)
+	}
+
+	return nil
+}
+
+// getSettingsList returns the list of objects under key in v. Lists may be
+// given as nested documents in the config file or as a JSON string through a
+// flag or environment variable.
+func getSettingsList(v *viper.Viper, key string) ([]map[string]interface{}, error) {
+	switch value := v.Get(key).(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if value == "" {
+			return nil, nil
+		}
+
+		settings := []map[string]interface{}{}
+		if err := json.Unmarshal([]byte(value), &settings); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %s", key, err)
+		}
+		return settings, nil
+	case []interface{}:
+		settings := []map[string]interface{}{}
+		for _, item := range value {
+			s, err := cast.ToStringMapE(item)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse %s: %s", key, err)
+			}
+			settings = append(settings, s)
+		}
+		return settings, nil
+	default:
+		return nil, fmt.Errorf("could not parse %s: expected a list, got %T", key, value)
+	}
+}
+
+// resolveSettings returns all of the settings of v, with the servers, routes
+// and phases it declares resolved the same way.
+func resolveSettings(v *viper.Viper) (map[string]interface{}, error) {
+	settings := v.AllSettings()
+
+	for _, key := range []string{"servers", "routes", "phases"} {
+		list, err := getSettingsList(v, key)
+		if err != nil {
+			return nil, err
+		}
+		if len(list) == 0 {
+			delete(settings, key)
+			continue
+		}
+
+		newViper := newProfileViper
+		if key == "servers" {
+			newViper = newServerViper
+		}
+
+		resolved := []interface{}{}
+		for _, s := range list {
+			r, err := resolveSettings(newViper(s))
+			if err != nil {
+				return nil, err
+			}
+			resolved = append(resolved, r)
+		}
+		settings[key] = resolved
+	}
+
+	return normalizeSettings(settings).(map[string]interface{}), nil
+}
+
+// normalizeSettings converts the maps decoded from YAML, which have
+// interface{} keys, to maps with string keys so they can be encoded as JSON.
+func normalizeSettings(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		return normalizeSettings(cast.ToStringMap(value))
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = normalizeSettings(v)
+		}
+		return value
+	case []interface{}:
+		for i, v := range value {
+			value[i] = normalizeSettings(v)
+		}
+		return value
+	default:
+		return value
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// ConnectionFaults describes faults injected at the connection level, across
+// all routes of a server.
+type ConnectionFaults struct {
+	// close each connection after this many requests; 0 for no limit
+	MaxRequests uint32
+
+	// probability of closing the connection after each request
+	CloseProbability float64
+
+	// close connections that have been idle for this long, earlier than the
+	// idle timeout clients expect; 0 to leave them open
+	IdleKillAfter time.Duration
+
+	// close connections with a TCP RST rather than a FIN when closing them
+	// because of a fault
+	AbortiveClose bool
+}
+
+type connectionParameters struct {
+	MaxRequests      *uint32  `json:"max_requests,omitempty"`
+	CloseProbability *float64 `json:"close_probability,omitempty"`
+	IdleKillAfter    *string  `json:"idle_kill_after,omitempty"`
+	AbortiveClose    bool     `json:"abortive_close"`
+}
+
+// buildConnectionFaults builds the connection faults of the server described by
+// v, or returns nil if none are enabled.
+func buildConnectionFaults(v *viper.Viper) (*ConnectionFaults, *connectionParameters, error) {
+	faults := &ConnectionFaults{
+		MaxRequests:      v.GetUint32("connection.max-requests"),
+		CloseProbability: v.GetFloat64("connection.close-probability"),
+		IdleKillAfter:    v.GetDuration("connection.idle-kill-after"),
+		AbortiveClose:    v.GetBool("connection.abortive-close"),
+	}
+
+	if faults.CloseProbability < 0 || faults.CloseProbability > 1 {
+		return nil, nil, fmt.Errorf("--connection-close-probability must be between 0 and 1, got: %v", faults.CloseProbability)
+	}
+	if faults.IdleKillAfter < 0 {
+		return nil, nil, fmt.Errorf("--connection-idle-kill-after must be >= 0, got: %s", faults.IdleKillAfter)
+	}
+
+	if faults.MaxRequests == 0 && faults.CloseProbability == 0 && faults.IdleKillAfter == 0 && !faults.AbortiveClose {
+		return nil, nil, nil
+	}
+
+	parameters := &connectionParameters{
+		AbortiveClose: faults.AbortiveClose,
+	}
+	if faults.MaxRequests > 0 {
+		parameters.MaxRequests = &faults.MaxRequests
+	}
+	if faults.CloseProbability > 0 {
+		parameters.CloseProbability = &faults.CloseProbability
+	}
+	if faults.IdleKillAfter > 0 {
+		s := faults.IdleKillAfter.String()
+		parameters.IdleKillAfter = &s
+	}
+
+	return faults, parameters, nil
+}
+
+type ConnectionStatistics struct {
+	// connections accepted from the listener, including refused and held ones
+	Accepted int64 `json:"accepted"`
+	// connections closed as soon as accepted because of the connection limit
+	Refused int64 `json:"refused"`
+	// connections currently open and served
+	Active int64 `json:"active"`
+	// connections currently accepted but not yet served because of the
+	// connection limit
+	Held int64 `json:"held"`
+
+	// the counts above over time, sampled when they change
+	Samples []*ConnectionSample `json:"samples"`
+
+	// connections closed by each fault
+	MaxRequestsCloses int64 `json:"max_requests_closes"`
+	RandomCloses      int64 `json:"random_closes"`
+	IdleKills         int64 `json:"idle_kills"`
+	// connections closed by the CLOSE (or, over HTTP/1.x, RESET) behavior of
+	// the error expression or rate limiter
+	ErrorCloses int64 `json:"error_closes"`
+
+	// closes above sent as a TCP RST
+	Resets int64 `json:"resets"`
+
+	// connections closed for not starting with a valid PROXY protocol header
+	ProxyProtocolFailures int64 `json:"proxy_protocol_failures"`
+}
+
+type ConnectionSample struct {
+	Time     time.Time `json:"time"`
+	Accepted int64     `json:"accepted"`
+	Refused  int64     `json:"refused"`
+	Active   int64     `json:"active"`
+	Held     int64     `json:"held"`
+}
+
+type connectionFault int
+
+const (
+	faultMaxRequests connectionFault = iota
+	faultRandomClose
+	faultIdleKill
+	faultErrorClose
+)
+
+// connections tracks the connections accepted by a server to limit them,
+// inject connection faults and count them.
+type connections struct {
+	faults ConnectionFaults
+	limit  ConnectionLimit
+
+	// holds a token for each admitted connection when they are limited
+	slots chan struct{}
+
+	mu         sync.Mutex
+	conns      map[string]*trackedConn
+	unixConns  int64
+	statistics ConnectionStatistics
+	last       ConnectionSample
+}
+
+func newConnections(faults ConnectionFaults, limit ConnectionLimit) *connections {
+	cs := &connections{
+		faults: faults,
+		limit:  limit,
+		conns:  map[string]*trackedConn{},
+		statistics: ConnectionStatistics{
+			Samples: []*ConnectionSample{},
+		},
+	}
+	if limit.MaxConnections > 0 {
+		cs.slots = make(chan struct{}, limit.MaxConnections)
+	}
+	return cs
+}
+
+// Listener returns listener with the connections it accepts tracked, and
+// limited if a connection limit is set.
+func (cs *connections) Listener(listener net.Listener) net.Listener {
+	if cs.slots != nil {
+		return newAdmissionListener(listener, cs)
+	}
+
+	return &trackingListener{
+		Listener:    listener,
+		connections: cs,
+	}
+}
+
+// get returns the connection from remoteAddr, as given by the RemoteAddr of
+// a request, or nil if it is not tracked.
+func (cs *connections) get(remoteAddr string) *trackedConn {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.conns[remoteAddr]
+}
+
+// ConnState is used as the ConnState hook of the server to kill idle
+// connections.
+func (cs *connections) ConnState(conn net.Conn, state http.ConnState) {
+	if cs.faults.IdleKillAfter == 0 {
+		return
+	}
+
+	c := cs.get(conn.RemoteAddr().String())
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+		c.idleTimer = nil
+	}
+	if state == http.StateIdle {
+		c.idleTimer = time.AfterFunc(cs.faults.IdleKillAfter, func() {
+			c.fault(faultIdleKill)
+			c.Close()
+		})
+	}
+}
+
+// WrapHTTP closes the connection of requests after they are served when they
+// hit the maximum number of requests of their connection, or at random, by
+// responding with Connection: close (a GOAWAY over HTTP/2).
+func (cs *connections) WrapHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		c := cs.get(r.RemoteAddr)
+		if c == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		n := atomic.AddUint32(&c.requests, 1)
+		switch {
+		case cs.faults.MaxRequests > 0 && n == cs.faults.MaxRequests:
+			c.fault(faultMaxRequests)
+			rw.Header().Set("Connection", "close")
+		case cs.faults.CloseProbability > 0 && rand.Float64() < cs.faults.CloseProbability:
+			c.fault(faultRandomClose)
+			rw.Header().Set("Connection", "close")
+		}
+
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), connectionKey, c)))
+	})
+}
+
+func (cs *connections) Statistics() *ConnectionStatistics {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	statistics := cs.statistics
+	statistics.Samples = append([]*ConnectionSample{}, cs.statistics.Samples...)
+	return &statistics
+}
+
+// sample records the connection counts every interval, when they changed,
+// until quit is closed.
+func (cs *connections) sample(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case t := <-ticker.C:
+			cs.mu.Lock()
+			sample := ConnectionSample{
+				Accepted: cs.statistics.Accepted,
+				Refused:  cs.statistics.Refused,
+				Active:   cs.statistics.Active,
+				Held:     cs.statistics.Held,
+			}
+			if sample != cs.last {
+				cs.last = sample
+				sample.Time = t.UTC()
+				cs.statistics.Samples = append(cs.statistics.Samples, &sample)
+			}
+			cs.mu.Unlock()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// requestConnection returns the tracked connection r arrived on, if any.
+func requestConnection(r *http.Request) *trackedConn {
+	c, _ := r.Context().Value(connectionKey).(*trackedConn)
+	return c
+}
+
+type trackingListener struct {
+	net.Listener
+	connections *connections
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.connections.mu.Lock()
+	l.connections.statistics.Accepted++
+	l.connections.mu.Unlock()
+
+	return l.connections.track(conn), nil
+}
+
+// track starts tracking conn, once admitted, until it is closed.
+func (cs *connections) track(conn net.Conn) *trackedConn {
+	c := &trackedConn{
+		Conn:        conn,
+		connections: cs,
+		remoteAddr:  conn.RemoteAddr(),
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	// clients of a unix domain socket usually share the same, empty, address;
+	// give each connection its own so they can be told apart
+	if conn.LocalAddr().Network() == "unix" {
+		cs.unixConns++
+		c.remoteAddr = &net.UnixAddr{Name: fmt.Sprintf("@%d", cs.unixConns), Net: "unix"}
+	}
+
+	cs.conns[c.RemoteAddr().String()] = c
+	cs.statistics.Active++
+
+	return c
+}
+
+// readdress makes addr, as given by the PROXY protocol header of c, the remote
+// address of c.
+func (cs *connections) readdress(c *trackedConn, addr net.Addr) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.conns[c.RemoteAddr().String()] == c {
+		delete(cs.conns, c.RemoteAddr().String())
+	}
+	c.remoteAddr = addr
+	cs.conns[addr.String()] = c
+}
+
+// open returns the number of connections tracked.
+func (cs *connections) open() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.conns)
+}
+
+// closeAll closes all of the connections tracked, including those hijacked by
+// h2c, which http.Server.Close does not close.
+func (cs *connections) closeAll() {
+	cs.mu.Lock()
+	conns := make([]*trackedConn, 0, len(cs.conns))
+	for _, c := range cs.conns {
+		conns = append(conns, c)
+	}
+	cs.mu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (cs *connections) recordProxyFailure() {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.statistics.ProxyProtocolFailures++
+}
+
+type trackedConn struct {
+	net.Conn
+	connections *connections
+	remoteAddr  net.Addr
+
+	requests uint32
+
+	mu        sync.Mutex
+	idleTimer *time.Timer
+	closeOnce sync.Once
+
+	// guarded by connections.mu
+	faulted bool
+}
+
+// fault counts the connection as closed because of fault and, if closes are
+// abortive, makes closing it send a TCP RST. Each connection is counted once.
+func (c *trackedConn) fault(fault connectionFault) {
+	cs := c.connections
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if c.faulted {
+		return
+	}
+	c.faulted = true
+
+	switch fault {
+	case faultMaxRequests:
+		cs.statistics.MaxRequestsCloses++
+	case faultRandomClose:
+		cs.statistics.RandomCloses++
+	case faultIdleKill:
+		cs.statistics.IdleKills++
+	case faultErrorClose:
+		cs.statistics.ErrorCloses++
+	}
+
+	if cs.faults.AbortiveClose {
+		if tc, ok := c.Conn.(*net.TCPConn); ok {
+			tc.SetLinger(0)
+			cs.statistics.Resets++
+		}
+	}
+}
+
+func (c *trackedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		if c.idleTimer != nil {
+			c.idleTimer.Stop()
+		}
+		c.mu.Unlock()
+
+		c.connections.mu.Lock()
+		if c.connections.conns[c.RemoteAddr().String()] == c {
+			delete(c.connections.conns, c.RemoteAddr().String())
+		}
+		c.connections.statistics.Active--
+		c.connections.mu.Unlock()
+
+		c.connections.release()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var ctlCmd = &cobra.Command{
+	Use:   "ctl",
+	Short: "Inspect and change the behavior of a running server through its admin API.",
+	Long:  "Inspect and change the behavior of a running server through its admin API.\nThe server is found through --admin-url, or else through the admin-address or address options.",
+}
+
+var ctlGetCmd = &cobra.Command{
+	Use:   "get",
+	Short: "Print the current settings of every route.",
+	Args:  cobra.NoArgs,
+	// errors come from the server rather than the command line
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminRequest(http.MethodGet, "", nil)
+	},
+}
+
+var ctlSetCmd = &cobra.Command{
+	Use:   "set KEY=VALUE...",
+	Short: "Replace the latency, error and/or rate-limit settings of a route.",
+	Long: `Replace the latency, error and/or rate-limit settings of a route.
+
+Keys use the same nested names as the config file. Each section given replaces
+the current one entirely, other sections are left untouched. For example:
+
+  http_test_server ctl set latency.normal.mean=2s latency.normal.stddev=500ms
+  http_test_server ctl set --route /slow error.expression='rand() < 0.5 ? 503 : false'`,
+	Args:         cobra.MinimumNArgs(1),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		update := map[string]interface{}{}
+		for _, arg := range args {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("expected KEY=VALUE, got: %s", arg)
+			}
+
+			path := strings.Split(parts[0], ".")
+			m := update
+			for _, k := range path[:len(path)-1] {
+				if _, ok := m[k].(map[string]interface{}); !ok {
+					m[k] = map[string]interface{}{}
+				}
+				m = m[k].(map[string]interface{})
+			}
+			m[path[len(path)-1]] = parts[1]
+		}
+
+		route, _ := cmd.Flags().GetString("route")
+		return adminRequest(http.MethodPut, route, update)
+	},
+}
+
+// adminRequest sends a request to the admin config endpoint of the server and
+// prints the resulting configuration.
+func adminRequest(method string, route string, body interface{}) error {
+	u, err := adminURL()
+	if err != nil {
+		return err
+	}
+
+	client := http.DefaultClient
+	if u.Scheme == "https" {
+		tlsConfig, err := adminTLSConfig()
+		if err != nil {
+			return err
+		}
+		client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		}
+	}
+	if u.Scheme == "unix" {
+		socket := u.Path
+		client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		}
+		u = &url.URL{Scheme: "http", Host: "unix"}
+	}
+
+	u.Path = adminPathPrefix + "/config"
+	if route != "" {
+		u.RawQuery = url.Values{"route": []string{route}}.Encode()
+	}
+
+	var b []byte
+	if body != nil {
+		b, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach admin API: %s", err)
+	}
+	defer resp.Body.Close()
+
+	b, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, b, "", "  "); err != nil {
+		return err
+	}
+	out.WriteTo(os.Stdout)
+	return nil
+}
+
+// adminURL returns the base URL of the admin API of the server, with the unix
+// scheme if it is served on a unix domain socket. The admin API is served over
+// TLS on the address of the server if it serves TLS, and in plain HTTP on the
+// admin address.
+func adminURL() (*url.URL, error) {
+	if s := viper.GetString("admin-url"); s != "" {
+		return url.Parse(s)
+	}
+
+	scheme := "http"
+	address := viper.GetString("admin-address")
+	if address == "" {
+		address = viper.GetString("address")
+		if viper.GetBool("tls.enabled") {
+			scheme = "https"
+		}
+	}
+	if strings.HasPrefix(address, unixAddressPrefix) {
+		return url.Parse(address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine admin API address from %s: %s", address, err)
+	}
+	if port == "0" {
+		return nil, fmt.Errorf("could not determine admin API address from %s: --admin-url is required when binding to port 0", address)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "localhost"
+	}
+
+	return &url.URL{Scheme: scheme, Host: net.JoinHostPort(host, port)}, nil
+}
+
+// adminTLSConfig returns the TLS configuration to reach the admin API of a
+// server serving TLS. Besides the system roots, the certificate of the server
+// is trusted if it was given, or else the certificate authority generated
+// next to the parameters file, along with the client CA. The client
+// certificate issued by the generated certificate authority is presented if
+// the server asks for one.
+func adminTLSConfig() (*tls.Config, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+
+	caFiles := []string{}
+	if certFile := viper.GetString("tls.cert-file"); certFile != "" {
+		caFiles = append(caFiles, certFile)
+	} else if parametersPath := viper.GetString("parameters-path"); parametersPath != "" {
+		caFiles = append(caFiles, filepath.Join(filepath.Dir(parametersPath), "ca.pem"))
+	}
+	if clientCAFile := viper.GetString("tls.client-ca-file"); clientCAFile != "" {
+		caFiles = append(caFiles, clientCAFile)
+	}
+	for _, caFile := range caFiles {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read TLS CA of the admin API: %s", err)
+		}
+		roots.AppendCertsFromPEM(pem)
+	}
+
+	config := &tls.Config{RootCAs: roots}
+
+	// the client certificate is only issued if the server verifies client
+	// certificates against the generated certificate authority
+	clientAuth := TLSClientAuth(viper.GetString("tls.client-auth"))
+	if clientAuth != TLSClientAuthNone && viper.GetString("tls.cert-file") == "" && viper.GetString("tls.client-ca-file") == "" {
+		if parametersPath := viper.GetString("parameters-path"); parametersPath != "" {
+			dir := filepath.Dir(parametersPath)
+			cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client-key.pem"))
+			if err != nil {
+				return nil, fmt.Errorf("could not load TLS client certificate of the admin API: %s", err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// latencyDistribution draws latencies independently of the state of the
+// server.
+type latencyDistribution interface {
+	draw() time.Duration
+}
+
+// LatencyMiddlewareDistribution injects latencies drawn from a distribution.
+type LatencyMiddlewareDistribution struct {
+	latencyBounds
+
+	distribution latencyDistribution
+}
+
+func NewLatencyMiddlewareDistribution(distribution latencyDistribution) *LatencyMiddlewareDistribution {
+	return &LatencyMiddlewareDistribution{
+		distribution: distribution,
+	}
+}
+
+func (lm *LatencyMiddlewareDistribution) WrapHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		d, _ := lm.sample(nil)
+		if !sleepLatency(r, d) {
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (lm *LatencyMiddlewareDistribution) sample(_ *expressionParameters) (time.Duration, error) {
+	return lm.draw(), nil
+}
+
+// draw draws a latency within the bounds of lm, so that it can be a component
+// of a mixture.
+func (lm *LatencyMiddlewareDistribution) draw() time.Duration {
+	return lm.clamp(lm.distribution.draw())
+}
+
+// scale returns d scaled by x.
+func scale(d time.Duration, x float64) time.Duration {
+	return duration(float64(d) * x)
+}
+
+// maxDuration is the longest duration.
+const maxDuration = time.Duration(math.MaxInt64)
+
+// duration converts ns to a duration, saturating instead of overflowing for
+// the draws of heavy tails too long to be represented.
+func duration(ns float64) time.Duration {
+	if ns >= math.MaxInt64 {
+		return maxDuration
+	}
+	return time.Duration(ns)
+}
+
+type constantDistribution struct {
+	value time.Duration
+}
+
+func (cd *constantDistribution) draw() time.Duration {
+	return cd.value
+}
+
+type uniformDistribution struct {
+	min, max time.Duration
+}
+
+func (ud *uniformDistribution) draw() time.Duration {
+	return ud.min + scale(ud.max-ud.min, rand.Float64())
+}
+
+type exponentialDistribution struct {
+	mean time.Duration
+}
+
+func (ed *exponentialDistribution) draw() time.Duration {
+	return scale(ed.mean, rand.ExpFloat64())
+}
+
+// lognormalDistribution is the distribution of a latency whose logarithm is
+// normally distributed, given by its median, e^mu, and sigma.
+type lognormalDistribution struct {
+	median time.Duration
+	sigma  float64
+}
+
+func (ld *lognormalDistribution) draw() time.Duration {
+	return scale(ld.median, math.Exp(ld.sigma*rand.NormFloat64()))
+}
+
+// paretoDistribution is a heavy tailed distribution of latencies of at least
+// scale. The lower shape, the heavier the tail.
+type paretoDistribution struct {
+	scale time.Duration
+	shape float64
+}
+
+func (pd *paretoDistribution) draw() time.Duration {
+	// 1 - rand.Float64() is in (0, 1]
+	return scale(pd.scale, math.Pow(1-rand.Float64(), -1/pd.shape))
+}
+
+// weibullDistribution has a tail heavier than exponential for a shape below
+// 1, and lighter above.
+type weibullDistribution struct {
+	scale time.Duration
+	shape float64
+}
+
+func (wd *weibullDistribution) draw() time.Duration {
+	return scale(wd.scale, math.Pow(rand.ExpFloat64(), 1/wd.shape))
+}
+
+// mixtureDistribution draws from one of its components, chosen at random by
+// weight, such as a fast mode most of the time and a slow mode otherwise.
+type mixtureDistribution struct {
+	components []latencyDistribution
+
+	// cumulative weights of components, normalized to end at 1
+	cumulative []float64
+}
+
+func newMixtureDistribution(components []latencyDistribution, weights []float64) *mixtureDistribution {
+	var total float64
+	for _, weight := range weights {
+		total += weight
+	}
+
+	md := &mixtureDistribution{
+		components: components,
+	}
+	var sum float64
+	for _, weight := range weights {
+		sum += weight
+		md.cumulative = append(md.cumulative, sum/total)
+	}
+	return md
+}
+
+func (md *mixtureDistribution) draw() time.Duration {
+	i := sort.SearchFloat64s(md.cumulative, rand.Float64())
+	if i == len(md.components) {
+		i--
+	}
+	return md.components[i].draw()
+}
+
+// latencyPercentile is the latency below which a fraction rank of latencies
+// fall, e.g. 0.99 for the p99.
+type latencyPercentile struct {
+	rank  float64
+	value time.Duration
+}
+
+// percentileDistribution is fitted to target percentiles of the latency, which
+// it reproduces exactly. The logarithm of the latency is interpolated linearly
+// between them against the standard normal quantiles of their ranks, so that
+// the distribution is lognormal between each pair of percentiles, and its
+// tails below the first and above the last follow the nearest pair.
+type percentileDistribution struct {
+	// standard normal quantiles of the ranks of the percentiles, increasing
+	z []float64
+
+	// logarithms of the percentiles, in ns
+	logs []float64
+}
+
+// newPercentileDistribution fits a distribution to percentiles, which must be
+// at least two, positive and ordered by increasing rank and value.
+func newPercentileDistribution(percentiles []latencyPercentile) *percentileDistribution {
+	pd := &percentileDistribution{}
+	for _, p := range percentiles {
+		pd.z = append(pd.z, normalQuantile(p.rank))
+		pd.logs = append(pd.logs, math.Log(float64(p.value)))
+	}
+	return pd
+}
+
+// normalQuantile returns the quantile of the standard normal distribution at
+// rank p, in (0, 1).
+func normalQuantile(p float64) float64 {
+	return math.Sqrt2 * math.Erfinv(2*p-1)
+}
+
+func (pd *percentileDistribution) draw() time.Duration {
+	z := rand.NormFloat64()
+
+	// interpolate between the percentiles on each side of z, or extrapolate
+	// from the first or last two
+	i := sort.SearchFloat64s(pd.z, z)
+	if i == 0 {
+		i = 1
+	} else if i == len(pd.z) {
+		i--
+	}
+
+	slope := (pd.logs[i] - pd.logs[i-1]) / (pd.z[i] - pd.z[i-1])
+	return duration(math.Exp(pd.logs[i-1] + (z-pd.z[i-1])*slope))
+}
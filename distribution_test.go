@@ -0,0 +1,348 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// samples is the number of latencies drawn to check a distribution.
+const samples = 50000
+
+// drawSorted draws samples latencies from distribution, in increasing order.
+func drawSorted(distribution latencyDistribution) []time.Duration {
+	draws := make([]time.Duration, samples)
+	for i := range draws {
+		draws[i] = distribution.draw()
+	}
+	sort.Slice(draws, func(i, j int) bool { return draws[i] < draws[j] })
+	return draws
+}
+
+// quantile returns the latency below which a fraction rank of sorted fall.
+func quantile(sorted []time.Duration, rank float64) time.Duration {
+	return sorted[int(rank*float64(len(sorted)-1))]
+}
+
+func mean(draws []time.Duration) time.Duration {
+	var sum float64
+	for _, d := range draws {
+		sum += float64(d)
+	}
+	return time.Duration(sum / float64(len(draws)))
+}
+
+// near returns whether got is within a fraction tolerance of want.
+func near(got, want time.Duration, tolerance float64) bool {
+	return math.Abs(float64(got-want)) <= tolerance*float64(want)
+}
+
+func TestDistributionDraw(t *testing.T) {
+	tests := []struct {
+		name         string
+		distribution latencyDistribution
+
+		// bounds of all draws; no upper bound if max is 0
+		min, max time.Duration
+		// expected mean and median, unchecked if 0
+		mean, median time.Duration
+	}{
+		{
+			name:         "constant",
+			distribution: &constantDistribution{value: 10 * time.Millisecond},
+			min:          10 * time.Millisecond,
+			max:          10 * time.Millisecond,
+		},
+		{
+			name:         "uniform",
+			distribution: &uniformDistribution{min: 10 * time.Millisecond, max: 20 * time.Millisecond},
+			min:          10 * time.Millisecond,
+			max:          20 * time.Millisecond,
+			mean:         15 * time.Millisecond,
+			median:       15 * time.Millisecond,
+		},
+		{
+			name:         "exponential",
+			distribution: &exponentialDistribution{mean: 10 * time.Millisecond},
+			mean:         10 * time.Millisecond,
+			median:       scale(10*time.Millisecond, math.Ln2),
+		},
+		{
+			name:         "lognormal",
+			distribution: &lognormalDistribution{median: 10 * time.Millisecond, sigma: 0.5},
+			mean:         scale(10*time.Millisecond, math.Exp(0.5*0.5/2)),
+			median:       10 * time.Millisecond,
+		},
+		{
+			name:         "pareto",
+			distribution: &paretoDistribution{scale: 10 * time.Millisecond, shape: 3},
+			min:          10 * time.Millisecond,
+			mean:         15 * time.Millisecond,
+			median:       scale(10*time.Millisecond, math.Pow(2, 1.0/3)),
+		},
+		{
+			name:         "weibull",
+			distribution: &weibullDistribution{scale: 10 * time.Millisecond, shape: 2},
+			mean:         scale(10*time.Millisecond, math.Gamma(1.5)),
+			median:       scale(10*time.Millisecond, math.Sqrt(math.Ln2)),
+		},
+		{
+			name: "mixture",
+			distribution: newMixtureDistribution(
+				[]latencyDistribution{&constantDistribution{value: 10 * time.Millisecond}, &constantDistribution{value: 110 * time.Millisecond}},
+				[]float64{9, 1},
+			),
+			min:    10 * time.Millisecond,
+			max:    110 * time.Millisecond,
+			mean:   20 * time.Millisecond,
+			median: 10 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			draws := drawSorted(tt.distribution)
+
+			if draws[0] < tt.min {
+				t.Fatalf("drew %s, below the minimum of %s", draws[0], tt.min)
+			}
+			if tt.max > 0 && draws[len(draws)-1] > tt.max {
+				t.Fatalf("drew %s, above the maximum of %s", draws[len(draws)-1], tt.max)
+			}
+			if got := mean(draws); tt.mean > 0 && !near(got, tt.mean, 0.05) {
+				t.Fatalf("got mean %s, want about %s", got, tt.mean)
+			}
+			if got := quantile(draws, 0.5); tt.median > 0 && !near(got, tt.median, 0.05) {
+				t.Fatalf("got median %s, want about %s", got, tt.median)
+			}
+		})
+	}
+}
+
+func TestDuration(t *testing.T) {
+	tests := []struct {
+		ns   float64
+		want time.Duration
+	}{
+		{ns: 0, want: 0},
+		{ns: 1.5e9, want: 1500 * time.Millisecond},
+		{ns: math.MaxInt64, want: maxDuration},
+		{ns: 1e30, want: maxDuration},
+		{ns: math.Inf(1), want: maxDuration},
+	}
+
+	for _, tt := range tests {
+		if got := duration(tt.ns); got != tt.want {
+			t.Errorf("duration(%g) = %s, want %s", tt.ns, got, tt.want)
+		}
+	}
+}
+
+func TestBuildLatencyDistribution(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		err      bool
+	}{
+		{name: "constant", settings: map[string]interface{}{"latency.distribution": "CONSTANT", "latency.constant.value": "10ms"}},
+		{name: "negative constant", settings: map[string]interface{}{"latency.distribution": "CONSTANT", "latency.constant.value": "-10ms"}, err: true},
+		{name: "uniform", settings: map[string]interface{}{"latency.distribution": "UNIFORM", "latency.uniform.min": "10ms", "latency.uniform.max": "20ms"}},
+		{name: "uniform max below min", settings: map[string]interface{}{"latency.distribution": "UNIFORM", "latency.uniform.min": "20ms", "latency.uniform.max": "10ms"}, err: true},
+		{name: "exponential", settings: map[string]interface{}{"latency.distribution": "EXPONENTIAL", "latency.exponential.mean": "10ms"}},
+		{name: "lognormal", settings: map[string]interface{}{"latency.distribution": "LOGNORMAL", "latency.lognormal.median": "10ms", "latency.lognormal.sigma": 0.5}},
+		{name: "negative lognormal sigma", settings: map[string]interface{}{"latency.distribution": "LOGNORMAL", "latency.lognormal.median": "10ms", "latency.lognormal.sigma": -0.5}, err: true},
+		{name: "pareto", settings: map[string]interface{}{"latency.distribution": "PARETO", "latency.pareto.scale": "10ms", "latency.pareto.shape": 1.5}},
+		{name: "pareto without shape", settings: map[string]interface{}{"latency.distribution": "PARETO", "latency.pareto.scale": "10ms"}, err: true},
+		{name: "weibull", settings: map[string]interface{}{"latency.distribution": "WEIBULL", "latency.weibull.scale": "10ms", "latency.weibull.shape": 0.5}},
+		{name: "weibull without shape", settings: map[string]interface{}{"latency.distribution": "WEIBULL", "latency.weibull.scale": "10ms"}, err: true},
+		{
+			name: "mixture",
+			settings: map[string]interface{}{"latency.distribution": "MIXTURE", "latency.mixture": `[
+				{"weight": 9, "distribution": "CONSTANT", "constant": {"value": "10ms"}},
+				{"weight": 1, "distribution": "PARETO", "pareto": {"scale": "100ms", "shape": 2}}
+			]`},
+		},
+		{name: "empty mixture", settings: map[string]interface{}{"latency.distribution": "MIXTURE", "latency.mixture": `[]`}, err: true},
+		{
+			name:     "mixture without weight",
+			settings: map[string]interface{}{"latency.distribution": "MIXTURE", "latency.mixture": `[{"distribution": "CONSTANT", "constant": {"value": "10ms"}}]`},
+			err:      true,
+		},
+		{
+			name:     "nested mixture",
+			settings: map[string]interface{}{"latency.distribution": "MIXTURE", "latency.mixture": `[{"weight": 1, "distribution": "MIXTURE", "mixture": []}]`},
+			err:      true,
+		},
+		{
+			name:     "mixture of expressions",
+			settings: map[string]interface{}{"latency.distribution": "MIXTURE", "latency.mixture": `[{"weight": 1, "distribution": "EXPRESSION", "expression": {"mean-ms": "10", "stddev-ms": "0"}}]`},
+			err:      true,
+		},
+		{name: "unknown distribution", settings: map[string]interface{}{"latency.distribution": "GAMMA"}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			for key, value := range tt.settings {
+				v.Set(key, value)
+			}
+
+			_, _, err := buildLatency(v, nil, true)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error: %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestNormalQuantile(t *testing.T) {
+	tests := []struct {
+		rank, want float64
+	}{
+		{rank: 0.5, want: 0},
+		{rank: 0.8413447460685429, want: 1},
+		{rank: 0.975, want: 1.959963984540054},
+		{rank: 0.025, want: -1.959963984540054},
+		{rank: 0.999, want: 3.090232306167813},
+	}
+
+	for _, tt := range tests {
+		if got := normalQuantile(tt.rank); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("normalQuantile(%g) = %g, want %g", tt.rank, got, tt.want)
+		}
+	}
+}
+
+func TestPercentileDistribution(t *testing.T) {
+	tests := []struct {
+		name        string
+		percentiles []latencyPercentile
+	}{
+		{
+			name: "p50 and p99",
+			percentiles: []latencyPercentile{
+				{rank: 0.5, value: 20 * time.Millisecond},
+				{rank: 0.99, value: 200 * time.Millisecond},
+			},
+		},
+		{
+			name: "all percentiles",
+			percentiles: []latencyPercentile{
+				{rank: 0.5, value: 10 * time.Millisecond},
+				{rank: 0.9, value: 30 * time.Millisecond},
+				{rank: 0.99, value: 250 * time.Millisecond},
+				{rank: 0.999, value: 2 * time.Second},
+			},
+		},
+		{
+			name: "flat between percentiles",
+			percentiles: []latencyPercentile{
+				{rank: 0.5, value: 50 * time.Millisecond},
+				{rank: 0.9, value: 50 * time.Millisecond},
+				{rank: 0.99, value: time.Second},
+			},
+		},
+		{
+			name: "upper tail only",
+			percentiles: []latencyPercentile{
+				{rank: 0.9, value: 100 * time.Millisecond},
+				{rank: 0.999, value: time.Second},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			draws := drawSorted(newPercentileDistribution(tt.percentiles))
+
+			// the rank of each percentile is between the fractions of draws
+			// below it and at most it, within 5 standard errors; draws are
+			// compared to it within 1µs as they are rounded to the ns
+			for _, p := range tt.percentiles {
+				n := float64(len(draws))
+				below := float64(sort.Search(len(draws), func(i int) bool { return draws[i] >= p.value-time.Microsecond })) / n
+				atMost := float64(sort.Search(len(draws), func(i int) bool { return draws[i] > p.value+time.Microsecond })) / n
+
+				tolerance := 5 * math.Sqrt(p.rank*(1-p.rank)/n)
+				if p.rank < below-tolerance || p.rank > atMost+tolerance {
+					t.Errorf("got %g of draws below %s and %g at most it, want %g", below, p.value, atMost, p.rank)
+				}
+			}
+		})
+	}
+}
+
+func TestLatencyBoundsClamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max time.Duration
+		d, want  time.Duration
+	}{
+		{name: "no bounds", d: 5 * time.Second, want: 5 * time.Second},
+		{name: "negative without bounds", d: -time.Second, want: 0},
+		{name: "below min", min: 10 * time.Millisecond, d: time.Millisecond, want: 10 * time.Millisecond},
+		{name: "within bounds", min: 10 * time.Millisecond, max: time.Second, d: 100 * time.Millisecond, want: 100 * time.Millisecond},
+		{name: "above max", min: 10 * time.Millisecond, max: time.Second, d: time.Minute, want: time.Second},
+		{name: "max without min", max: time.Second, d: maxDuration, want: time.Second},
+		{name: "equal bounds", min: time.Second, max: time.Second, d: 0, want: time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &latencyBounds{}
+			b.setBounds(tt.min, tt.max)
+			if got := b.clamp(tt.d); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildLatencyPercentiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		min, max time.Duration
+		err      bool
+	}{
+		{name: "p50 and p99", settings: map[string]interface{}{"latency.percentiles.p50": "20ms", "latency.percentiles.p99": "200ms"}},
+		{name: "single percentile", settings: map[string]interface{}{"latency.percentiles.p99": "200ms"}, err: true},
+		{name: "decreasing", settings: map[string]interface{}{"latency.percentiles.p50": "200ms", "latency.percentiles.p99": "20ms"}, err: true},
+		{name: "negative", settings: map[string]interface{}{"latency.percentiles.p50": "-20ms", "latency.percentiles.p99": "200ms"}, err: true},
+		{
+			name:     "bounded",
+			settings: map[string]interface{}{"latency.percentiles.p50": "20ms", "latency.percentiles.p99": "200ms", "latency.min": "5ms", "latency.max": "1s"},
+			min:      5 * time.Millisecond,
+			max:      time.Second,
+		},
+		{name: "max below min", settings: map[string]interface{}{"latency.percentiles.p50": "20ms", "latency.percentiles.p99": "200ms", "latency.min": "1s", "latency.max": "5ms"}, err: true},
+		{name: "negative min", settings: map[string]interface{}{"latency.percentiles.p50": "20ms", "latency.percentiles.p99": "200ms", "latency.min": "-5ms"}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.Set("latency.distribution", "PERCENTILES")
+			for key, value := range tt.settings {
+				v.Set(key, value)
+			}
+
+			middleware, _, err := buildLatency(v, nil, true)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error: %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+
+			lm := middleware.(*LatencyMiddlewareDistribution)
+			if lm.min != tt.min || lm.max != tt.max {
+				t.Fatalf("got bounds [%s, %s], want [%s, %s]", lm.min, lm.max, tt.min, tt.max)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type DrainBehavior string
+
+const (
+	// serves new requests as usual until the listener is closed
+	DrainBehaviorNone DrainBehavior = "NONE"
+
+	// rejects new requests with a 503 and Connection: close (a GOAWAY over
+	// HTTP/2)
+	DrainBehaviorClose DrainBehavior = "CLOSE"
+
+	// rejects new requests with a 503 and a Retry-After header
+	DrainBehaviorRetryAfter DrainBehavior = "RETRY_AFTER"
+)
+
+// Drain describes how a server is taken out of rotation when it shuts down:
+// /_health fails first, then new requests are rejected while the listener is
+// still open, and finally the listener is closed and in-flight requests are
+// allowed to finish.
+type Drain struct {
+	// bounds the whole drain; requests still in flight are aborted after it
+	Timeout time.Duration
+
+	// how long /_health fails before new requests are rejected
+	HealthDelay time.Duration
+
+	Behavior DrainBehavior
+
+	// how long new requests are rejected before the listener is closed
+	RejectDelay time.Duration
+
+	// advertised in the Retry-After header by the RETRY_AFTER behavior
+	RetryAfter time.Duration
+}
+
+type drainParameters struct {
+	Timeout     string  `json:"timeout"`
+	HealthDelay string  `json:"health_delay"`
+	Behavior    string  `json:"behavior"`
+	RejectDelay string  `json:"reject_delay"`
+	RetryAfter  *string `json:"retry_after,omitempty"`
+}
+
+// buildDrain builds the drain behavior of the server described by v.
+func buildDrain(v *viper.Viper) (*Drain, *drainParameters, error) {
+	drain := &Drain{
+		Timeout:     v.GetDuration("drain.timeout"),
+		HealthDelay: v.GetDuration("drain.health-delay"),
+		Behavior:    DrainBehavior(strings.ToUpper(v.GetString("drain.behavior"))),
+		RejectDelay: v.GetDuration("drain.reject-delay"),
+		RetryAfter:  v.GetDuration("drain.retry-after"),
+	}
+
+	if drain.Timeout <= 0 {
+		return nil, nil, fmt.Errorf("--drain-timeout must be > 0, got: %s", drain.Timeout)
+	}
+	if drain.HealthDelay < 0 {
+		return nil, nil, fmt.Errorf("--drain-health-delay must be >= 0, got: %s", drain.HealthDelay)
+	}
+	if drain.RejectDelay < 0 {
+		return nil, nil, fmt.Errorf("--drain-reject-delay must be >= 0, got: %s", drain.RejectDelay)
+	}
+	if drain.HealthDelay+drain.RejectDelay >= drain.Timeout {
+		return nil, nil, fmt.Errorf("--drain-health-delay + --drain-reject-delay must be < --drain-timeout, got: %s + %s >= %s", drain.HealthDelay, drain.RejectDelay, drain.Timeout)
+	}
+	if drain.RetryAfter < 0 {
+		return nil, nil, fmt.Errorf("--drain-retry-after must be >= 0, got: %s", drain.RetryAfter)
+	}
+
+	switch drain.Behavior {
+	case DrainBehaviorNone, DrainBehaviorClose, DrainBehaviorRetryAfter:
+	default:
+		return nil, nil, fmt.Errorf("unknown drain-behavior value: %s", drain.Behavior)
+	}
+
+	parameters := &drainParameters{
+		Timeout:     drain.Timeout.String(),
+		HealthDelay: drain.HealthDelay.String(),
+		Behavior:    string(drain.Behavior),
+		RejectDelay: drain.RejectDelay.String(),
+	}
+	if drain.Behavior == DrainBehaviorRetryAfter {
+		s := drain.RetryAfter.String()
+		parameters.RetryAfter = &s
+	}
+
+	return drain, parameters, nil
+}
+
+type DrainStatistics struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// new requests rejected while draining
+	Rejected int64 `json:"rejected"`
+
+	// whether the drain timed out, and the requests it aborted as a result
+	TimedOut bool  `json:"timed_out"`
+	Aborted  int64 `json:"aborted"`
+}
+
+const (
+	EventDrainStart  = "drain_start"
+	EventDrainReject = "drain_reject"
+	EventDrainEnd    = "drain_end"
+)
+
+// drain tracks requests in flight so the server can be drained of them.
+type drain struct {
+	options Drain
+
+	// paths served even when rejecting requests, such as health checks
+	exempt map[string]bool
+
+	inFlight  int64
+	draining  int32
+	rejecting int32
+
+	mu         sync.Mutex
+	statistics *DrainStatistics
+}
+
+func newDrain(options Drain) *drain {
+	if options.Timeout == 0 {
+		options.Timeout = 30 * time.Second
+	}
+	if options.Behavior == "" {
+		options.Behavior = DrainBehaviorNone
+	}
+	return &drain{
+		options: options,
+		exempt:  map[string]bool{},
+	}
+}
+
+// Draining returns whether the server is being drained, and so should fail
+// its health checks.
+func (d *drain) Draining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+// InFlight returns the number of requests in flight.
+func (d *drain) InFlight() int64 {
+	return atomic.LoadInt64(&d.inFlight)
+}
+
+// WrapHTTP counts requests in flight and, once the server rejects new
+// requests, responds to them with a 503 instead of serving them. Exempt paths
+// and the admin API are always served.
+func (d *drain) WrapHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&d.rejecting) == 1 && !d.exempt[r.URL.Path] && !strings.HasPrefix(r.URL.Path, adminPathPrefix+"/") {
+			d.mu.Lock()
+			d.statistics.Rejected++
+			d.mu.Unlock()
+
+			switch d.options.Behavior {
+			case DrainBehaviorClose:
+				rw.Header().Set("Connection", "close")
+			case DrainBehaviorRetryAfter:
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.options.RetryAfter.Seconds()))))
+			}
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		atomic.AddInt64(&d.inFlight, 1)
+		defer atomic.AddInt64(&d.inFlight, -1)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (d *drain) Statistics() *DrainStatistics {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.statistics == nil {
+		return nil
+	}
+	statistics := *d.statistics
+	return &statistics
+}
+
+// drainPollInterval is how often requests in flight and open connections are
+// checked for while waiting for them to finish.
+const drainPollInterval = 10 * time.Millisecond
+
+// waitClosed waits until no request is in flight and all connections are
+// closed, or returns the error of ctx once it is done. http.Server.Shutdown
+// does not wait for connections hijacked by h2c, which it no longer tracks;
+// they are sent a GOAWAY by it and close once their streams are done.
+func (s *Server) waitClosed(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&s.drain.inFlight) > 0 || s.connections.open() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// wait waits for delay, or until ctx is done.
+func wait(ctx context.Context, delay time.Duration) {
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// Shutdown drains the server and shuts it down. If the drain times out, the
+// requests still in flight are aborted and the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	d := s.drain
+
+	ctx, cancel := context.WithTimeout(ctx, d.options.Timeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	d.mu.Lock()
+	d.statistics = &DrainStatistics{Start: now}
+	d.mu.Unlock()
+
+	s.logger.Println("Server is draining...")
+	atomic.StoreInt32(&d.draining, 1)
+	s.recordEvent(&Event{Time: now, Type: EventDrainStart})
+
+	wait(ctx, d.options.HealthDelay)
+
+	if d.options.Behavior != DrainBehaviorNone {
+		atomic.StoreInt32(&d.rejecting, 1)
+		s.recordEvent(&Event{Time: time.Now().UTC(), Type: EventDrainReject, Name: string(d.options.Behavior)})
+		s.server.SetKeepAlivesEnabled(false)
+
+		wait(ctx, d.options.RejectDelay)
+	}
+
+	s.server.SetKeepAlivesEnabled(false)
+	err := s.server.Shutdown(ctx)
+	if err == nil {
+		err = s.waitClosed(ctx)
+	}
+	if err != nil {
+		aborted := atomic.LoadInt64(&d.inFlight)
+		s.logger.Printf("Drain timed out, aborting %d requests in flight", aborted)
+		s.server.Close()
+		s.connections.closeAll()
+
+		d.mu.Lock()
+		d.statistics.TimedOut = true
+		d.statistics.Aborted = aborted
+		d.mu.Unlock()
+	}
+
+	now = time.Now().UTC()
+	d.mu.Lock()
+	d.statistics.End = now
+	d.mu.Unlock()
+	s.recordEvent(&Event{Time: now, Type: EventDrainEnd})
+
+	close(s.quit)
+	s.admin.Close()
+
+	return err
+}
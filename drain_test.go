@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestBuildDrain(t *testing.T) {
+	tests := []struct {
+		name                              string
+		timeout, healthDelay, rejectDelay time.Duration
+		behavior                          string
+		err                               bool
+	}{
+		{name: "valid", timeout: 30 * time.Second, healthDelay: 5 * time.Second, rejectDelay: 5 * time.Second, behavior: "CLOSE"},
+		{name: "no delays", timeout: time.Second, behavior: "NONE"},
+		{name: "no timeout", timeout: 0, behavior: "CLOSE", err: true},
+		{name: "negative health delay", timeout: time.Second, healthDelay: -1, behavior: "CLOSE", err: true},
+		{name: "negative reject delay", timeout: time.Second, rejectDelay: -1, behavior: "CLOSE", err: true},
+		{name: "delays as long as timeout", timeout: 10 * time.Second, healthDelay: 5 * time.Second, rejectDelay: 5 * time.Second, behavior: "CLOSE", err: true},
+		{name: "delays longer than timeout", timeout: time.Second, healthDelay: 2 * time.Second, behavior: "CLOSE", err: true},
+		{name: "unknown behavior", timeout: time.Second, behavior: "DROP", err: true},
+		{name: "lowercase behavior", timeout: time.Second, behavior: "retry_after"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.Set("drain.timeout", tt.timeout)
+			v.Set("drain.health-delay", tt.healthDelay)
+			v.Set("drain.reject-delay", tt.rejectDelay)
+			v.Set("drain.behavior", tt.behavior)
+
+			_, _, err := buildDrain(v)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error: %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	const (
+		healthDelay = 200 * time.Millisecond
+		rejectDelay = 200 * time.Millisecond
+	)
+
+	tests := []struct {
+		behavior DrainBehavior
+
+		// whether requests are rejected before the listener is closed, and
+		// how
+		rejects bool
+		check   func(resp *http.Response) bool
+	}{
+		{behavior: DrainBehaviorNone},
+		{behavior: DrainBehaviorClose, rejects: true, check: func(resp *http.Response) bool { return resp.Close }},
+		{behavior: DrainBehaviorRetryAfter, rejects: true, check: func(resp *http.Response) bool { return resp.Header.Get("Retry-After") == "1" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.behavior), func(t *testing.T) {
+			s, url := startServer(t,
+				WithDrain(Drain{Timeout: 5 * time.Second, HealthDelay: healthDelay, Behavior: tt.behavior, RejectDelay: rejectDelay, RetryAfter: time.Second}),
+				WithRoute("/slow", nil, WithLatency(NewLatencyMiddlewareDistribution(&constantDistribution{value: 600 * time.Millisecond}))),
+			)
+			defer stopServer(s)
+
+			// a request in flight when the drain starts is allowed to finish
+			slow := make(chan int, 1)
+			go func() {
+				resp, err := testClient.Get(url + "/slow")
+				if err != nil {
+					slow <- 0
+					return
+				}
+				resp.Body.Close()
+				slow <- resp.StatusCode
+			}()
+			waitFor(t, func() bool { return s.drain.InFlight() == 1 })
+
+			done := make(chan error, 1)
+			go func() { done <- s.Shutdown(context.Background()) }()
+
+			// the health check fails first, while requests are still served
+			time.Sleep(healthDelay / 2)
+			expectStatus(t, url+"/_health", http.StatusServiceUnavailable)
+			expectStatus(t, url+"/", http.StatusNoContent)
+
+			// then new requests are rejected, unless the listener is closed
+			// right away
+			time.Sleep(healthDelay)
+			if tt.rejects {
+				if resp := expectStatus(t, url+"/", http.StatusServiceUnavailable); !tt.check(resp) {
+					t.Fatalf("rejected request not told how to retry: %v", resp.Header)
+				}
+				expectStatus(t, url+"/_health", http.StatusServiceUnavailable)
+			} else if resp, err := testClient.Get(url + "/"); err == nil {
+				resp.Body.Close()
+				t.Fatal("listener still open after the health delay")
+			}
+
+			if err := <-done; err != nil {
+				t.Fatalf("drain failed: %s", err)
+			}
+			if status := <-slow; status != http.StatusNoContent {
+				t.Fatalf("got status %d for the request in flight, want %d", status, http.StatusNoContent)
+			}
+
+			statistics := s.drain.Statistics()
+			var rejected int64
+			if tt.rejects {
+				rejected = 1
+			}
+			if statistics.Rejected != rejected || statistics.TimedOut || statistics.Aborted != 0 {
+				t.Fatalf("got drain statistics %+v, want %d rejected and no timeout", statistics, rejected)
+			}
+
+			var types []string
+			for _, event := range s.Events() {
+				types = append(types, event.Type)
+			}
+			want := []string{EventDrainStart, EventDrainReject, EventDrainEnd}
+			if !tt.rejects {
+				want = []string{EventDrainStart, EventDrainEnd}
+			}
+			if len(types) != len(want) {
+				t.Fatalf("got events %v, want %v", types, want)
+			}
+			for i := range want {
+				if types[i] != want[i] {
+					t.Fatalf("got events %v, want %v", types, want)
+				}
+			}
+		})
+	}
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	s, url := startServer(t,
+		WithDrain(Drain{Timeout: 200 * time.Millisecond, Behavior: DrainBehaviorClose}),
+		WithRoute("/slow", nil, WithLatency(NewLatencyMiddlewareDistribution(&constantDistribution{value: 5 * time.Second}))),
+	)
+	defer stopServer(s)
+
+	go func() {
+		if resp, err := testClient.Get(url + "/slow"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	waitFor(t, func() bool { return s.drain.InFlight() == 1 })
+
+	start := time.Now()
+	if err := s.Shutdown(context.Background()); err == nil {
+		t.Fatal("drain did not time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("drain took %s, want about 200ms", elapsed)
+	}
+
+	statistics := s.drain.Statistics()
+	if !statistics.TimedOut || statistics.Aborted != 1 {
+		t.Fatalf("got drain statistics %+v, want a timeout aborting 1 request", statistics)
+	}
+}
+
+// testClient does not reuse connections, so that each request sees the
+// current state of the server.
+var testClient = &http.Client{
+	Transport: &http.Transport{DisableKeepAlives: true},
+	Timeout:   10 * time.Second,
+}
+
+// startServer serves a server built from opts on a local port, until it is
+// shut down or stopped, and returns it along with its base URL.
+func startServer(t *testing.T, opts ...func(*ServerOptions)) (*Server, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer(opts...)
+	go s.Listen(listener)
+
+	url := "http://" + listener.Addr().String()
+	waitFor(t, func() bool {
+		resp, err := testClient.Get(url + s.health.options.Path)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	})
+	return s, url
+}
+
+// stopServer closes s and its connections without draining it.
+func stopServer(s *Server) {
+	s.server.Close()
+	s.connections.closeAll()
+}
+
+// expectStatus fails t unless a GET of url responds with status, and returns
+// the response.
+func expectStatus(t *testing.T, url string, status int) *http.Response {
+	t.Helper()
+
+	resp, err := testClient.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %s", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != status {
+		t.Fatalf("GET %s: got status %d, want %d", url, resp.StatusCode, status)
+	}
+	return resp
+}
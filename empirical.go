@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+// empiricalDistribution reproduces latencies measured elsewhere, given either
+// as samples or as histogram buckets. Latencies are drawn uniformly within the
+// bucket chosen, samples being buckets of a single latency.
+type empiricalDistribution struct {
+	buckets []empiricalBucket
+
+	// cumulative counts of buckets, normalized to end at 1
+	cumulative []float64
+}
+
+type empiricalBucket struct {
+	lower, upper time.Duration
+	count        float64
+}
+
+// empiricalSummary describes an empirical distribution in the parameters
+// file.
+type empiricalSummary struct {
+	Count float64
+	Min   time.Duration
+	Max   time.Duration
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	P999  time.Duration
+}
+
+// loadEmpiricalDistribution reads the latencies of path, a CSV or JSON file
+// as told by its extension, of samples or of buckets.
+//
+// A CSV file has one row per sample, or one row per bucket of its upper bound
+// and its count, optionally preceded by a header. A JSON file is a list of
+// samples, or of buckets with an "le" upper bound and a "count". Latencies are
+// either numbers of milliseconds or durations such as "250ms". The lower bound
+// of each bucket is the upper bound of the previous one, or 0 for the first.
+// If cumulative is true, the count of each bucket includes those of the
+// previous ones, as in Prometheus histograms.
+func loadEmpiricalDistribution(path string, cumulative bool) (*empiricalDistribution, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read empirical latencies: %s", err)
+	}
+
+	var samples []time.Duration
+	var buckets []empiricalBucket
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		samples, buckets, err = parseEmpiricalCSV(b)
+	case ".json":
+		samples, buckets, err = parseEmpiricalJSON(b)
+	default:
+		return nil, fmt.Errorf("empirical latencies must be a .csv or .json file, got: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse empirical latencies: %s", err)
+	}
+
+	if samples != nil {
+		if cumulative {
+			return nil, fmt.Errorf("cumulative counts only apply to histogram buckets")
+		}
+		return newEmpiricalSamples(samples)
+	}
+	return newEmpiricalHistogram(buckets, cumulative)
+}
+
+func parseEmpiricalCSV(b []byte) ([]time.Duration, []empiricalBucket, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// skip the header, if any
+	if len(records) > 0 {
+		if _, err := parseLatency(records[0][0]); err != nil {
+			records = records[1:]
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("no latencies")
+	}
+
+	switch len(records[0]) {
+	case 1:
+		samples := []time.Duration{}
+		for i, record := range records {
+			d, err := parseLatency(record[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("row %d: %s", i+1, err)
+			}
+			samples = append(samples, d)
+		}
+		return samples, nil, nil
+	case 2:
+		buckets := []empiricalBucket{}
+		for i, record := range records {
+			upper, err := parseLatency(record[0])
+			if err != nil {
+				return nil, nil, fmt.Errorf("row %d: %s", i+1, err)
+			}
+			count, err := strconv.ParseFloat(record[1], 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("row %d: invalid count: %s", i+1, record[1])
+			}
+			buckets = append(buckets, empiricalBucket{upper: upper, count: count})
+		}
+		return nil, buckets, nil
+	default:
+		return nil, nil, fmt.Errorf("expected rows of a sample, or of a bucket upper bound and count, got %d columns", len(records[0]))
+	}
+}
+
+func parseEmpiricalJSON(b []byte) ([]time.Duration, []empiricalBucket, error) {
+	items := []interface{}{}
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil, fmt.Errorf("no latencies")
+	}
+
+	if _, ok := items[0].(map[string]interface{}); !ok {
+		samples := []time.Duration{}
+		for i, item := range items {
+			d, err := parseLatency(fmt.Sprint(item))
+			if err != nil {
+				return nil, nil, fmt.Errorf("item %d: %s", i, err)
+			}
+			samples = append(samples, d)
+		}
+		return samples, nil, nil
+	}
+
+	buckets := []empiricalBucket{}
+	for i, item := range items {
+		m, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, nil, fmt.Errorf("item %d: expected a bucket, got: %v", i, item)
+		}
+		upper, err := parseLatency(fmt.Sprint(m["le"]))
+		if err != nil {
+			return nil, nil, fmt.Errorf("item %d: %s", i, err)
+		}
+		count, err := cast.ToFloat64E(m["count"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("item %d: invalid count: %v", i, m["count"])
+		}
+		buckets = append(buckets, empiricalBucket{upper: upper, count: count})
+	}
+	return nil, buckets, nil
+}
+
+// parseLatency parses a number of milliseconds or a duration. +Inf, the
+// upper bound of the last bucket of Prometheus histograms, is parsed as the
+// longest duration.
+func parseLatency(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "+Inf" || s == "Inf" {
+		return maxDuration, nil
+	}
+	if ms, err := strconv.ParseFloat(s, 64); err == nil {
+		return duration(ms * float64(time.Millisecond)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid latency: %s", s)
+	}
+	return d, nil
+}
+
+func newEmpiricalSamples(samples []time.Duration) (*empiricalDistribution, error) {
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	if samples[0] < 0 {
+		return nil, fmt.Errorf("empirical latencies must be >= 0, got: %s", samples[0])
+	}
+
+	buckets := []empiricalBucket{}
+	for _, sample := range samples {
+		buckets = append(buckets, empiricalBucket{lower: sample, upper: sample, count: 1})
+	}
+	return newEmpiricalDistribution(buckets), nil
+}
+
+func newEmpiricalHistogram(buckets []empiricalBucket, cumulative bool) (*empiricalDistribution, error) {
+	var lower time.Duration
+	var previous, total float64
+	for i := range buckets {
+		b := &buckets[i]
+		if b.upper <= lower && (i > 0 || b.upper < 0) {
+			return nil, fmt.Errorf("empirical bucket upper bounds must be >= 0 and increasing, got %s after %s", b.upper, lower)
+		}
+		b.lower = lower
+		lower = b.upper
+
+		if cumulative {
+			if b.count < previous {
+				return nil, fmt.Errorf("cumulative empirical bucket counts must not decrease, got %v after %v", b.count, previous)
+			}
+			b.count, previous = b.count-previous, b.count
+		}
+		if b.count < 0 {
+			return nil, fmt.Errorf("empirical bucket counts must be >= 0, got: %v", b.count)
+		}
+		total += b.count
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("empirical buckets are empty")
+	}
+
+	// latencies beyond the last finite bound are known to be at least that
+	// long, but not how much longer: they are drawn as that bound
+	if last := &buckets[len(buckets)-1]; last.upper == maxDuration {
+		last.upper = last.lower
+	}
+
+	return newEmpiricalDistribution(buckets), nil
+}
+
+func newEmpiricalDistribution(buckets []empiricalBucket) *empiricalDistribution {
+	var total float64
+	for _, b := range buckets {
+		total += b.count
+	}
+
+	ed := &empiricalDistribution{
+		buckets: buckets,
+	}
+	var sum float64
+	for _, b := range buckets {
+		sum += b.count
+		ed.cumulative = append(ed.cumulative, sum/total)
+	}
+	return ed
+}
+
+func (ed *empiricalDistribution) draw() time.Duration {
+	return ed.quantile(rand.Float64())
+}
+
+// quantile returns the latency below which a fraction p of latencies fall.
+func (ed *empiricalDistribution) quantile(p float64) time.Duration {
+	i := sort.SearchFloat64s(ed.cumulative, p)
+	if i == len(ed.buckets) {
+		i--
+	}
+	// skip empty buckets, so that latencies are only drawn from those that
+	// have any
+	for ed.buckets[i].count == 0 && i < len(ed.buckets)-1 {
+		i++
+	}
+
+	var start float64
+	if i > 0 {
+		start = ed.cumulative[i-1]
+	}
+	b := ed.buckets[i]
+	fraction := 0.0
+	if ed.cumulative[i] > start {
+		fraction = (p - start) / (ed.cumulative[i] - start)
+	}
+	return b.lower + scale(b.upper-b.lower, fraction)
+}
+
+func (ed *empiricalDistribution) summary() empiricalSummary {
+	s := empiricalSummary{
+		P50:  ed.quantile(0.5),
+		P90:  ed.quantile(0.9),
+		P99:  ed.quantile(0.99),
+		P999: ed.quantile(0.999),
+	}
+
+	var mean float64
+	first := true
+	for _, b := range ed.buckets {
+		if b.count == 0 {
+			continue
+		}
+		if first {
+			s.Min = b.lower
+			first = false
+		}
+		s.Max = b.upper
+		s.Count += b.count
+		mean += b.count * (float64(b.lower) + float64(b.upper)) / 2
+	}
+	s.Mean = duration(mean / s.Count)
+
+	return s
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLatency(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		err  bool
+	}{
+		{s: "250", want: 250 * time.Millisecond},
+		{s: "0.5", want: 500 * time.Microsecond},
+		{s: " 1.5e3 ", want: 1500 * time.Millisecond},
+		{s: "250ms", want: 250 * time.Millisecond},
+		{s: "1m30s", want: 90 * time.Second},
+		{s: "+Inf", want: maxDuration},
+		{s: "Inf", want: maxDuration},
+		{s: "fast", err: true},
+		{s: "", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseLatency(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("parseLatency(%q): got error %v, want error: %v", tt.s, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseLatency(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestLoadEmpiricalDistribution(t *testing.T) {
+	dir, err := ioutil.TempDir("", "empirical")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name       string
+		file       string
+		content    string
+		cumulative bool
+
+		// latencies at given ranks; nil if loading fails
+		quantiles map[float64]time.Duration
+	}{
+		{
+			name:      "CSV samples",
+			file:      "samples.csv",
+			content:   "5\n1\n3\n",
+			quantiles: map[float64]time.Duration{0.2: time.Millisecond, 0.5: 3 * time.Millisecond, 0.9: 5 * time.Millisecond},
+		},
+		{
+			name:      "CSV samples with header and comments",
+			file:      "samples.csv",
+			content:   "latency\n# warmup excluded\n10ms\n 20ms\n",
+			quantiles: map[float64]time.Duration{0.25: 10 * time.Millisecond, 0.75: 20 * time.Millisecond},
+		},
+		{
+			name:      "CSV buckets",
+			file:      "buckets.csv",
+			content:   "le,count\n10ms,50\n20ms,50\n",
+			quantiles: map[float64]time.Duration{0.25: 5 * time.Millisecond, 0.5: 10 * time.Millisecond, 0.75: 15 * time.Millisecond},
+		},
+		{
+			name:      "CSV buckets with an empty one",
+			file:      "buckets.csv",
+			content:   "10,50\n20,0\n30,50\n",
+			quantiles: map[float64]time.Duration{0.5: 10 * time.Millisecond, 0.75: 25 * time.Millisecond},
+		},
+		{
+			name:       "CSV cumulative buckets",
+			file:       "buckets.csv",
+			content:    "10ms,50\n20ms,100\n+Inf,100\n",
+			cumulative: true,
+			quantiles:  map[float64]time.Duration{0.75: 15 * time.Millisecond, 1: 20 * time.Millisecond},
+		},
+		{
+			name:      "JSON samples",
+			file:      "samples.json",
+			content:   `[5, "1ms", 3]`,
+			quantiles: map[float64]time.Duration{0.2: time.Millisecond, 0.5: 3 * time.Millisecond, 0.9: 5 * time.Millisecond},
+		},
+		{
+			name:      "JSON buckets",
+			file:      "buckets.json",
+			content:   `[{"le": "10ms", "count": 50}, {"le": 20, "count": 50}]`,
+			quantiles: map[float64]time.Duration{0.25: 5 * time.Millisecond, 0.75: 15 * time.Millisecond},
+		},
+		{
+			name:      "JSON buckets beyond the last bound",
+			file:      "buckets.JSON",
+			content:   `[{"le": 10, "count": 90}, {"le": "+Inf", "count": 10}]`,
+			quantiles: map[float64]time.Duration{0.45: 5 * time.Millisecond, 0.95: 10 * time.Millisecond},
+		},
+		{name: "unknown extension", file: "samples.txt", content: "5\n"},
+		{name: "CSV header only", file: "samples.csv", content: "latency\n"},
+		{name: "CSV too many columns", file: "buckets.csv", content: "10ms,50,1\n"},
+		{name: "CSV invalid latency", file: "samples.csv", content: "5\nfast\n"},
+		{name: "CSV invalid count", file: "buckets.csv", content: "10ms,many\n"},
+		{name: "negative sample", file: "samples.csv", content: "5\n-1\n"},
+		{name: "decreasing bounds", file: "buckets.csv", content: "20ms,50\n10ms,50\n"},
+		{name: "repeated bound", file: "buckets.csv", content: "10ms,50\n10ms,50\n"},
+		{name: "negative count", file: "buckets.csv", content: "10ms,50\n20ms,-1\n"},
+		{name: "decreasing cumulative counts", file: "buckets.csv", content: "10ms,50\n20ms,40\n", cumulative: true},
+		{name: "cumulative samples", file: "samples.csv", content: "5\n1\n", cumulative: true},
+		{name: "empty buckets", file: "buckets.csv", content: "10ms,0\n20ms,0\n"},
+		{name: "JSON empty list", file: "samples.json", content: `[]`},
+		{name: "JSON invalid count", file: "buckets.json", content: `[{"le": 10, "count": "many"}]`},
+		{name: "JSON mixed items", file: "buckets.json", content: `[{"le": 10, "count": 1}, 20]`},
+		{name: "JSON not a list", file: "samples.json", content: `{"le": 10}`},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("%d-%s", i, tt.file))
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ed, err := loadEmpiricalDistribution(path, tt.cumulative)
+			if (err != nil) != (tt.quantiles == nil) {
+				t.Fatalf("got error %v, want error: %v", err, tt.quantiles == nil)
+			}
+			for rank, want := range tt.quantiles {
+				if got := ed.quantile(rank); got != want {
+					t.Errorf("got p%g of %s, want %s", rank*100, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEmpiricalSummary(t *testing.T) {
+	ed, err := newEmpiricalHistogram([]empiricalBucket{
+		{upper: 10 * time.Millisecond, count: 0},
+		{upper: 20 * time.Millisecond, count: 90},
+		{upper: 40 * time.Millisecond, count: 10},
+		{upper: maxDuration, count: 0},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := ed.summary()
+	if got.Count != 100 || got.Min != 10*time.Millisecond || got.Max != 40*time.Millisecond || got.Mean != 16500*time.Microsecond {
+		t.Fatalf("got count %v, min %s, max %s and mean %s, want 100, 10ms, 40ms and 16.5ms", got.Count, got.Min, got.Max, got.Mean)
+	}
+	for _, p := range []struct {
+		name      string
+		got, want time.Duration
+	}{
+		{name: "p50", got: got.P50, want: 10*time.Millisecond + scale(10*time.Millisecond, 0.5/0.9)},
+		{name: "p90", got: got.P90, want: 20 * time.Millisecond},
+		{name: "p99", got: got.P99, want: 38 * time.Millisecond},
+		{name: "p99.9", got: got.P999, want: 39800 * time.Microsecond},
+	} {
+		if !near(p.got, p.want, 1e-6) {
+			t.Errorf("got %s of %s, want %s", p.name, p.got, p.want)
+		}
+	}
+}
@@ -11,13 +11,14 @@ import (
 )
 
 type ErrorExpressionMiddleware struct {
-	expr *govaluate.EvaluableExpression
+	expr   *govaluate.EvaluableExpression
+	replay *replay
 
 	activeRequests  uint32
 	serverStartTime time.Time
 }
 
-func NewErrorExpressionMiddleware(expression string) (*ErrorExpressionMiddleware, error) {
+func NewErrorExpressionMiddleware(expression string, replay *replay) (*ErrorExpressionMiddleware, error) {
 	expr, err := govaluate.NewEvaluableExpressionWithFunctions(expression, expressionFunctions)
 	if err != nil {
 		return nil, fmt.Errorf("could not use expression: %s", err)
@@ -25,10 +26,18 @@ func NewErrorExpressionMiddleware(expression string) (*ErrorExpressionMiddleware
 
 	return &ErrorExpressionMiddleware{
 		expr:            expr,
+		replay:          replay,
 		serverStartTime: time.Now(),
 	}, nil
 }
 
+func (em *ErrorExpressionMiddleware) startAt(start time.Time) {
+	em.serverStartTime = start
+	if em.replay != nil {
+		em.replay.start = start
+	}
+}
+
 func (em *ErrorExpressionMiddleware) WrapHTTP(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		atomic.AddUint32(&em.activeRequests, 1)
@@ -44,11 +53,13 @@ func (em *ErrorExpressionMiddleware) WrapHTTP(next http.Handler) http.Handler {
 			t:              time.Now().Sub(em.serverStartTime),
 		}
 
-		v, err := em.expr.Eval(parameters)
+		v, err := em.evaluate(parameters)
 		if err != nil {
-			errFn(fmt.Errorf("cannot evaluate mean expression: %s", err))
+			detailsFromRequest(r).setErrorResult("error")
+			errFn(err)
 			return
 		}
+		detailsFromRequest(r).setErrorResult(fmt.Sprint(v))
 
 		switch v := v.(type) {
 		case float64:
@@ -56,20 +67,10 @@ func (em *ErrorExpressionMiddleware) WrapHTTP(next http.Handler) http.Handler {
 			rw.WriteHeader(code)
 			fmt.Fprintln(rw, http.StatusText(code))
 		case string:
-			switch v {
-			case "CLOSE":
-				hj, ok := rw.(http.Hijacker)
-				if !ok {
-					panic("connection not hijackable") // should never happen
-				}
-				conn, _, err := hj.Hijack()
-				if err != nil {
-					http.Error(rw, fmt.Sprintf("could not hijack connection: %s", err.Error()), http.StatusInternalServerError)
-					return
-				}
-				conn.Close() // drop connection
-			default:
-				errFn(fmt.Errorf("expression returned a string, '%s', but it was not recognized", v))
+			if v == "RESET" {
+				resetStream(rw, r)
+			} else {
+				closeConnection(rw, r)
 			}
 		case bool:
 			if v {
@@ -77,8 +78,32 @@ func (em *ErrorExpressionMiddleware) WrapHTTP(next http.Handler) http.Handler {
 			} else {
 				next.ServeHTTP(rw, r)
 			}
-		default:
-			errFn(fmt.Errorf("expression did not return an expected type, returned: %T", v))
 		}
 	})
 }
+
+// evaluate evaluates the expression given parameters. It returns either a
+// bool, a float64 status code or one of the strings CLOSE and RESET.
+func (em *ErrorExpressionMiddleware) evaluate(parameters *expressionParameters) (interface{}, error) {
+	v, err := em.expr.Eval(parameters.withReplay(em.replay))
+	if err != nil {
+		return nil, fmt.Errorf("cannot evaluate expression: %s", err)
+	}
+
+	switch v := v.(type) {
+	case float64:
+		if v < 100 || v > 999 {
+			return nil, fmt.Errorf("expression returned %v, which is not a valid HTTP status code", v)
+		}
+		return v, nil
+	case string:
+		if v != "CLOSE" && v != "RESET" {
+			return nil, fmt.Errorf("expression returned a string, '%s', but it was not recognized", v)
+		}
+		return v, nil
+	case bool:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("expression did not return an expected type, returned: %T", v)
+	}
+}
@@ -26,9 +26,34 @@ var expressionFunctions = map[string]govaluate.ExpressionFunction{
 	},
 }
 
+// expressionVariables are the variables available to expressions. Those of
+// a replay only are if a replay is configured.
+var expressionVariables = []string{"active_requests", "pi", "t", "replay_latency_ms", "replay_latency_stddev_ms", "replay_error_rate", "replay_request_rate"}
+
+// healthExpressionVariables are the variables available to health
+// expressions, which cannot refer to a replay.
+var healthExpressionVariables = []string{"active_requests", "pi", "t"}
+
+// checkVariables returns an error if expr refers to a variable that is not
+// one of variables.
+func checkVariables(expr *govaluate.EvaluableExpression, variables []string) error {
+	for _, name := range expr.Vars() {
+		known := false
+		for _, variable := range variables {
+			known = known || name == variable
+		}
+		if !known {
+			return fmt.Errorf("unknown variable name: %s; expected one of %v", name, variables)
+		}
+	}
+	return nil
+}
+
 type expressionParameters struct {
 	t              time.Duration
 	activeRequests uint32
+
+	replay *replay
 }
 
 func (p *expressionParameters) Get(name string) (interface{}, error) {
@@ -40,6 +65,16 @@ func (p *expressionParameters) Get(name string) (interface{}, error) {
 	case "t":
 		return int64(p.t / time.Second), nil
 	default:
-		return nil, fmt.Errorf("unknown variable name: %s", name)
+		return p.replay.variable(name, p.t)
+	}
+}
+
+// withReplay returns p with the variables of replay.
+func (p *expressionParameters) withReplay(replay *replay) *expressionParameters {
+	if replay == nil {
+		return p
 	}
+	withReplay := *p
+	withReplay.replay = replay
+	return &withReplay
 }
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	"github.com/spf13/cast"
+	"github.com/spf13/viper"
+)
+
+// Health describes the health check endpoints of a server. The health and
+// readiness endpoints fail during unhealthy windows, while flapping and
+// whenever the expression says so. Liveness only fails until the server
+// listens.
+type Health struct {
+	Path   string
+	Method string
+
+	HealthyStatus   int
+	UnhealthyStatus int
+
+	// evaluates to whether the server is healthy, or to a status code to
+	// respond with; nil for always healthy
+	Expression *govaluate.EvaluableExpression
+
+	UnhealthyWindows []HealthWindow
+
+	// alternate between being healthy and unhealthy for these durations,
+	// healthy first; flapping is off unless both are set
+	FlapHealthy   time.Duration
+	FlapUnhealthy time.Duration
+
+	// empty to disable the endpoint
+	LivenessPath  string
+	ReadinessPath string
+
+	// how long readiness fails after the server starts listening
+	ReadinessDelay time.Duration
+}
+
+// HealthWindow is a time window, relative to when the server starts
+// listening, in which it is unhealthy. A Duration of 0 lasts forever.
+type HealthWindow struct {
+	Start    time.Duration
+	Duration time.Duration
+}
+
+func (w HealthWindow) contains(t time.Duration) bool {
+	return t >= w.Start && (w.Duration == 0 || t < w.Start+w.Duration)
+}
+
+type healthParameters struct {
+	Path            string                   `json:"path"`
+	Method          string                   `json:"method,omitempty"`
+	HealthyStatus   int                      `json:"healthy_status"`
+	UnhealthyStatus int                      `json:"unhealthy_status"`
+	Expression      string                   `json:"expression,omitempty"`
+	UnhealthyWindow []healthWindowParameters `json:"unhealthy_windows,omitempty"`
+	FlapHealthy     *string                  `json:"flap_healthy,omitempty"`
+	FlapUnhealthy   *string                  `json:"flap_unhealthy,omitempty"`
+	LivenessPath    string                   `json:"liveness_path,omitempty"`
+	ReadinessPath   string                   `json:"readiness_path,omitempty"`
+	ReadinessDelay  string                   `json:"readiness_delay"`
+}
+
+type healthWindowParameters struct {
+	Start    string `json:"start"`
+	Duration string `json:"duration,omitempty"`
+}
+
+// buildHealth builds the health check endpoints of the server described by v.
+func buildHealth(v *viper.Viper) (*Health, *healthParameters, error) {
+	health := &Health{
+		Path:            v.GetString("health.path"),
+		Method:          strings.ToUpper(v.GetString("health.method")),
+		HealthyStatus:   v.GetInt("health.healthy-status"),
+		UnhealthyStatus: v.GetInt("health.unhealthy-status"),
+		FlapHealthy:     v.GetDuration("health.flap.healthy"),
+		FlapUnhealthy:   v.GetDuration("health.flap.unhealthy"),
+		LivenessPath:    v.GetString("health.liveness-path"),
+		ReadinessPath:   v.GetString("health.readiness-path"),
+		ReadinessDelay:  v.GetDuration("health.readiness-delay"),
+	}
+
+	paths := map[string]bool{}
+	for i, path := range []string{health.Path, health.LivenessPath, health.ReadinessPath} {
+		// only the liveness and readiness endpoints can be disabled
+		if path == "" && i > 0 {
+			continue
+		}
+		if !strings.HasPrefix(path, "/") || path == "/" || strings.HasPrefix(path, adminPathPrefix+"/") {
+			return nil, nil, fmt.Errorf("health check path must start with / and not be / or under %s, got: '%s'", adminPathPrefix, path)
+		}
+		if paths[path] {
+			return nil, nil, fmt.Errorf("health check path %s is used more than once", path)
+		}
+		paths[path] = true
+	}
+
+	for _, status := range []int{health.HealthyStatus, health.UnhealthyStatus} {
+		if status < 100 || status > 999 {
+			return nil, nil, fmt.Errorf("%d is not a valid HTTP status code", status)
+		}
+	}
+
+	if health.FlapHealthy < 0 || health.FlapUnhealthy < 0 {
+		return nil, nil, fmt.Errorf("--health-flap-healthy and --health-flap-unhealthy must be >= 0")
+	}
+	if health.ReadinessDelay < 0 {
+		return nil, nil, fmt.Errorf("--health-readiness-delay must be >= 0, got: %s", health.ReadinessDelay)
+	}
+
+	parameters := &healthParameters{
+		Path:            health.Path,
+		Method:          health.Method,
+		HealthyStatus:   health.HealthyStatus,
+		UnhealthyStatus: health.UnhealthyStatus,
+		LivenessPath:    health.LivenessPath,
+		ReadinessPath:   health.ReadinessPath,
+		ReadinessDelay:  health.ReadinessDelay.String(),
+	}
+
+	if expression := v.GetString("health.expression"); expression != "" {
+		expr, err := govaluate.NewEvaluableExpressionWithFunctions(expression, expressionFunctions)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not use health expression: %s", err)
+		}
+		if err := checkVariables(expr, healthExpressionVariables); err != nil {
+			return nil, nil, fmt.Errorf("could not use health expression: %s", err)
+		}
+		health.Expression = expr
+		parameters.Expression = expression
+	}
+
+	settings, err := getSettingsList(v, "health.unhealthy-windows")
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, s := range settings {
+		start, err := cast.ToDurationE(s["start"])
+		if err != nil || start < 0 {
+			return nil, nil, fmt.Errorf("unhealthy window %d: start must be a duration >= 0", i)
+		}
+		var duration time.Duration
+		if value, ok := s["duration"]; ok {
+			duration, err = cast.ToDurationE(value)
+			if err != nil || duration < 0 {
+				return nil, nil, fmt.Errorf("unhealthy window %d: duration must be a duration >= 0", i)
+			}
+		}
+
+		health.UnhealthyWindows = append(health.UnhealthyWindows, HealthWindow{Start: start, Duration: duration})
+
+		windowParameters := healthWindowParameters{Start: start.String()}
+		if duration > 0 {
+			windowParameters.Duration = duration.String()
+		}
+		parameters.UnhealthyWindow = append(parameters.UnhealthyWindow, windowParameters)
+	}
+
+	if health.FlapHealthy > 0 && health.FlapUnhealthy > 0 {
+		healthy, unhealthy := health.FlapHealthy.String(), health.FlapUnhealthy.String()
+		parameters.FlapHealthy = &healthy
+		parameters.FlapUnhealthy = &unhealthy
+	}
+
+	return health, parameters, nil
+}
+
+// evaluate evaluates the health expression given parameters. It returns
+// either a bool or a float64 status code.
+func (h *Health) evaluate(parameters *expressionParameters) (interface{}, error) {
+	if h.Expression == nil {
+		return true, nil
+	}
+
+	v, err := h.Expression.Eval(parameters)
+	if err != nil {
+		return nil, fmt.Errorf("cannot evaluate health expression: %s", err)
+	}
+
+	switch v := v.(type) {
+	case float64:
+		if v < 100 || v > 999 {
+			return nil, fmt.Errorf("health expression returned %v, which is not a valid HTTP status code", v)
+		}
+		return v, nil
+	case bool:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("health expression did not return an expected type, returned: %T", v)
+	}
+}
+
+// status returns the status code the health endpoint responds with t after
+// the server started listening.
+func (h *Health) status(t time.Duration, activeRequests uint32) (int, error) {
+	for _, window := range h.UnhealthyWindows {
+		if window.contains(t) {
+			return h.UnhealthyStatus, nil
+		}
+	}
+
+	if h.FlapHealthy > 0 && h.FlapUnhealthy > 0 && t%(h.FlapHealthy+h.FlapUnhealthy) >= h.FlapHealthy {
+		return h.UnhealthyStatus, nil
+	}
+
+	v, err := h.evaluate(&expressionParameters{
+		activeRequests: activeRequests,
+		t:              t,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := v.(type) {
+	case float64:
+		return int(v), nil
+	case bool:
+		if !v {
+			return h.UnhealthyStatus, nil
+		}
+	}
+	return h.HealthyStatus, nil
+}
+
+type HealthStatistics struct {
+	// by endpoint: health, liveness or readiness
+	Probes map[string]*HealthProbeStatistics `json:"probes"`
+}
+
+type HealthProbeStatistics struct {
+	Healthy   int64 `json:"healthy"`
+	Unhealthy int64 `json:"unhealthy"`
+}
+
+const (
+	healthProbe    = "health"
+	livenessProbe  = "liveness"
+	readinessProbe = "readiness"
+)
+
+// health serves the health check endpoints of a server and counts the probes
+// they receive.
+type health struct {
+	options Health
+
+	listening int32
+	start     time.Time
+
+	mu         sync.Mutex
+	statistics HealthStatistics
+}
+
+func newHealth(options Health) *health {
+	if options.Path == "" {
+		options.Path = "/_health"
+	}
+	if options.HealthyStatus == 0 {
+		options.HealthyStatus = http.StatusNoContent
+	}
+	if options.UnhealthyStatus == 0 {
+		options.UnhealthyStatus = http.StatusServiceUnavailable
+	}
+
+	return &health{
+		options: options,
+		statistics: HealthStatistics{
+			Probes: map[string]*HealthProbeStatistics{},
+		},
+	}
+}
+
+// Paths returns the paths of the health check endpoints.
+func (h *health) Paths() []string {
+	paths := []string{h.options.Path}
+	for _, path := range []string{h.options.LivenessPath, h.options.ReadinessPath} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// Listening marks the server as listening, from which point t is measured.
+func (h *health) Listening(start time.Time) {
+	h.mu.Lock()
+	h.start = start
+	h.mu.Unlock()
+	atomic.StoreInt32(&h.listening, 1)
+}
+
+func (h *health) count(probe string, healthy bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	statistics, ok := h.statistics.Probes[probe]
+	if !ok {
+		statistics = &HealthProbeStatistics{}
+		h.statistics.Probes[probe] = statistics
+	}
+	if healthy {
+		statistics.Healthy++
+	} else {
+		statistics.Unhealthy++
+	}
+}
+
+func (h *health) Statistics() *HealthStatistics {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	statistics := &HealthStatistics{
+		Probes: map[string]*HealthProbeStatistics{},
+	}
+	for probe, s := range h.statistics.Probes {
+		probeStatistics := *s
+		statistics.Probes[probe] = &probeStatistics
+	}
+	return statistics
+}
+
+// handler returns the handler of the probe endpoint, responding with the
+// status returned by status.
+func (h *health) handler(probe string, status func() (int, error)) http.Handler {
+	var methods []string
+	if h.options.Method != "" {
+		methods = []string{h.options.Method}
+	}
+
+	return NewMethodMiddleware(methods).WrapHTTP(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		code, err := status()
+		if err != nil {
+			h.count(probe, false)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		h.count(probe, code == h.options.HealthyStatus)
+		rw.WriteHeader(code)
+	}))
+}
+
+// elapsed returns how long the server has been listening for, or false if it
+// is not yet.
+func (h *health) elapsed() (time.Duration, bool) {
+	if atomic.LoadInt32(&h.listening) == 0 {
+		return 0, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Since(h.start), true
+}
+
+// healthStatus fails while the server is not listening or draining, and
+// otherwise as described by its health options.
+func (s *Server) healthStatus() (int, error) {
+	t, ok := s.health.elapsed()
+	if !ok || s.drain.Draining() {
+		return s.health.options.UnhealthyStatus, nil
+	}
+	return s.health.options.status(t, uint32(s.drain.InFlight()))
+}
+
+// livenessStatus only fails while the server is not listening.
+func (s *Server) livenessStatus() (int, error) {
+	if _, ok := s.health.elapsed(); !ok {
+		return s.health.options.UnhealthyStatus, nil
+	}
+	return s.health.options.HealthyStatus, nil
+}
+
+// readinessStatus fails for the readiness delay after the server starts
+// listening, and then like healthStatus.
+func (s *Server) readinessStatus() (int, error) {
+	if t, ok := s.health.elapsed(); ok && t < s.health.options.ReadinessDelay {
+		return s.health.options.UnhealthyStatus, nil
+	}
+	return s.healthStatus()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Knetic/govaluate"
+	"github.com/spf13/viper"
+)
+
+func TestBuildHealth(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]interface{}
+		err      bool
+	}{
+		{name: "defaults"},
+		{name: "relative path", settings: map[string]interface{}{"health.path": "health"}, err: true},
+		{name: "root path", settings: map[string]interface{}{"health.path": "/"}, err: true},
+		{name: "admin path", settings: map[string]interface{}{"health.path": "/_admin/health"}, err: true},
+		{name: "liveness and readiness", settings: map[string]interface{}{"health.liveness-path": "/_live", "health.readiness-path": "/_ready"}},
+		{name: "shared path", settings: map[string]interface{}{"health.liveness-path": "/_health"}, err: true},
+		{name: "invalid status", settings: map[string]interface{}{"health.unhealthy-status": 42}, err: true},
+		{name: "negative flapping", settings: map[string]interface{}{"health.flap.healthy": -time.Second}, err: true},
+		{name: "negative readiness delay", settings: map[string]interface{}{"health.readiness-delay": -time.Second}, err: true},
+		{name: "expression", settings: map[string]interface{}{"health.expression": "t < 10 && active_requests < 100"}},
+		{name: "invalid expression", settings: map[string]interface{}{"health.expression": "t <"}, err: true},
+		{name: "unknown variable", settings: map[string]interface{}{"health.expression": "requests < 100"}, err: true},
+		{name: "replay variable", settings: map[string]interface{}{"health.expression": "replay_error_rate < 0.5"}, err: true},
+		{name: "windows", settings: map[string]interface{}{"health.unhealthy-windows": `[{"start": "10s", "duration": "5s"}, {"start": "1m"}]`}},
+		{name: "window without start", settings: map[string]interface{}{"health.unhealthy-windows": `[{"duration": "5s"}]`}, err: true},
+		{name: "invalid window start", settings: map[string]interface{}{"health.unhealthy-windows": `[{"start": "soon"}]`}, err: true},
+		{name: "negative window duration", settings: map[string]interface{}{"health.unhealthy-windows": `[{"start": "10s", "duration": "-5s"}]`}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.Set("health.path", "/_health")
+			v.Set("health.healthy-status", 204)
+			v.Set("health.unhealthy-status", 503)
+			for key, value := range tt.settings {
+				v.Set(key, value)
+			}
+
+			_, _, err := buildHealth(v)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error: %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestHealthStatus(t *testing.T) {
+	expression := func(s string) *govaluate.EvaluableExpression {
+		expr, err := govaluate.NewEvaluableExpressionWithFunctions(s, expressionFunctions)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return expr
+	}
+
+	tests := []struct {
+		name           string
+		health         Health
+		t              time.Duration
+		activeRequests uint32
+		want           int
+		err            bool
+	}{
+		{name: "healthy", t: time.Minute, want: 204},
+		{
+			name:   "before window",
+			health: Health{UnhealthyWindows: []HealthWindow{{Start: 10 * time.Second, Duration: 5 * time.Second}}},
+			t:      9 * time.Second,
+			want:   204,
+		},
+		{
+			name:   "window start",
+			health: Health{UnhealthyWindows: []HealthWindow{{Start: 10 * time.Second, Duration: 5 * time.Second}}},
+			t:      10 * time.Second,
+			want:   503,
+		},
+		{
+			name:   "window end",
+			health: Health{UnhealthyWindows: []HealthWindow{{Start: 10 * time.Second, Duration: 5 * time.Second}}},
+			t:      15 * time.Second,
+			want:   204,
+		},
+		{
+			name:   "endless window",
+			health: Health{UnhealthyWindows: []HealthWindow{{Start: 10 * time.Second}}},
+			t:      time.Hour,
+			want:   503,
+		},
+		{
+			name:   "second window",
+			health: Health{UnhealthyWindows: []HealthWindow{{Start: time.Second, Duration: time.Second}, {Start: 5 * time.Second, Duration: time.Second}}},
+			t:      5500 * time.Millisecond,
+			want:   503,
+		},
+		{
+			name:   "flapping healthy",
+			health: Health{FlapHealthy: 3 * time.Second, FlapUnhealthy: time.Second},
+			t:      2 * time.Second,
+			want:   204,
+		},
+		{
+			name:   "flapping unhealthy",
+			health: Health{FlapHealthy: 3 * time.Second, FlapUnhealthy: time.Second},
+			t:      3500 * time.Millisecond,
+			want:   503,
+		},
+		{
+			name:   "flapping healthy again",
+			health: Health{FlapHealthy: 3 * time.Second, FlapUnhealthy: time.Second},
+			t:      4 * time.Second,
+			want:   204,
+		},
+		{
+			name:   "flapping later cycle",
+			health: Health{FlapHealthy: 3 * time.Second, FlapUnhealthy: time.Second},
+			t:      43 * time.Second,
+			want:   503,
+		},
+		{
+			name:   "flapping off without unhealthy duration",
+			health: Health{FlapHealthy: 3 * time.Second},
+			t:      3500 * time.Millisecond,
+			want:   204,
+		},
+		{
+			name:   "window over flapping",
+			health: Health{FlapHealthy: time.Hour, FlapUnhealthy: time.Second, UnhealthyWindows: []HealthWindow{{Start: 0, Duration: time.Second}}},
+			t:      0,
+			want:   503,
+		},
+		{
+			name:           "expression false",
+			health:         Health{Expression: expression("active_requests < 10")},
+			activeRequests: 10,
+			want:           503,
+		},
+		{
+			name:           "expression true",
+			health:         Health{Expression: expression("active_requests < 10")},
+			activeRequests: 9,
+			want:           204,
+		},
+		{
+			name:   "expression over time",
+			health: Health{Expression: expression("t >= 30 ? 500 : true")},
+			t:      30 * time.Second,
+			want:   500,
+		},
+		{
+			name:   "expression status out of range",
+			health: Health{Expression: expression("42")},
+			err:    true,
+		},
+		{
+			name:   "expression of another type",
+			health: Health{Expression: expression("'healthy'")},
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := tt.health
+			health.HealthyStatus = 204
+			health.UnhealthyStatus = 503
+
+			status, err := health.status(tt.t, tt.activeRequests)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error: %v", err, tt.err)
+			}
+			if !tt.err && status != tt.want {
+				t.Fatalf("got status %d, want %d", status, tt.want)
+			}
+		})
+	}
+}
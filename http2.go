@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
+)
+
+type http2Parameters struct {
+	MaxConcurrentStreams uint32 `json:"max_concurrent_streams"`
+}
+
+// buildHTTP2Config builds the HTTP/2 configuration of the server described by
+// v, or returns nil if HTTP/2 is disabled.
+func buildHTTP2Config(v *viper.Viper) (*http2.Server, *http2Parameters) {
+	if !v.GetBool("http2.enabled") {
+		return nil, nil
+	}
+
+	config := &http2.Server{
+		MaxConcurrentStreams: v.GetUint32("http2.max-concurrent-streams"),
+	}
+	return config, &http2Parameters{MaxConcurrentStreams: config.MaxConcurrentStreams}
+}
+
+// http2StreamID returns the ID of the HTTP/2 stream rw responds on. The
+// http2 package does not expose it so it is read from the response writer,
+// once unwrapped by the middlewares wrapping it.
+func http2StreamID(rw http.ResponseWriter) (uint32, bool) {
+	for {
+		w, ok := rw.(*responseWriterWrapper)
+		if !ok {
+			break
+		}
+		rw = w.ResponseWriter
+	}
+
+	v := reflect.ValueOf(rw)
+	for _, field := range []string{"rws", "stream", "id"} {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return 0, false
+			}
+			v = v.Elem()
+		}
+		if v.Kind() != reflect.Struct {
+			return 0, false
+		}
+		v = v.FieldByName(field)
+		if !v.IsValid() {
+			return 0, false
+		}
+	}
+	if v.Kind() != reflect.Uint32 {
+		return 0, false
+	}
+	return uint32(v.Uint()), true
+}
+
+// closeConnection drops the connection r arrived on without responding. Over
+// HTTP/2, where the connection carries other requests, the connection is shut
+// down with a GOAWAY, letting the streams already in flight complete, and the
+// stream of r is reset.
+func closeConnection(rw http.ResponseWriter, r *http.Request) {
+	if c := requestConnection(r); c != nil {
+		c.fault(faultErrorClose)
+	}
+
+	if r.ProtoMajor != 2 {
+		hj, ok := rw.(http.Hijacker)
+		if !ok {
+			panic("connection not hijackable") // should never happen
+		}
+		conn, _, err := hj.Hijack()
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("could not hijack connection: %s", err.Error()), http.StatusInternalServerError)
+			return
+		}
+		conn.Close() // drop connection
+		return
+	}
+
+	// the http2 server only sends a GOAWAY once it writes the headers of a
+	// response with Connection: close, so they are flushed before the stream
+	// is reset, without a body
+	rw.Header().Set("Connection", "close")
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	if f, ok := rw.(http.Flusher); ok {
+		f.Flush()
+	}
+	resetStream(rw, r)
+}
+
+// resetStream aborts r without responding: its stream is reset with a
+// RST_STREAM over HTTP/2 and, as HTTP/1.x has no streams, its connection is
+// closed otherwise.
+func resetStream(rw http.ResponseWriter, r *http.Request) {
+	if c := requestConnection(r); c != nil && r.ProtoMajor != 2 {
+		c.fault(faultErrorClose)
+	}
+
+	// the server aborts the response, rather than logging a panic, when a
+	// handler panics with ErrAbortHandler
+	panic(http.ErrAbortHandler)
+}
@@ -11,7 +11,47 @@ import (
 	"github.com/Knetic/govaluate"
 )
 
+// latencySampler is implemented by latency middlewares to draw the latency
+// injected into a request given the current expression parameters.
+type latencySampler interface {
+	sample(parameters *expressionParameters) (time.Duration, error)
+}
+
+// latencyMiddleware is implemented by all latency middlewares.
+type latencyMiddleware interface {
+	Middleware
+	latencySampler
+
+	setBounds(min, max time.Duration)
+}
+
+// latencyBounds clamps the latencies drawn by a latency middleware, which are
+// at least 0 if it has no bounds.
+type latencyBounds struct {
+	min time.Duration
+
+	// no upper bound if 0
+	max time.Duration
+}
+
+func (b *latencyBounds) setBounds(min, max time.Duration) {
+	b.min = min
+	b.max = max
+}
+
+func (b *latencyBounds) clamp(d time.Duration) time.Duration {
+	if d < b.min {
+		return b.min
+	}
+	if b.max > 0 && d > b.max {
+		return b.max
+	}
+	return d
+}
+
 type LatencyMiddlewareNormal struct {
+	latencyBounds
+
 	mean   time.Duration
 	stddev time.Duration
 }
@@ -25,21 +65,30 @@ func NewLatencyMiddlewareNormal(mean time.Duration, stddev time.Duration) *Laten
 
 func (lm *LatencyMiddlewareNormal) WrapHTTP(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		d := time.Duration(rand.NormFloat64())*lm.stddev + lm.mean
-		time.Sleep(d)
+		d, _ := lm.sample(nil)
+		if !sleepLatency(r, d) {
+			return
+		}
 		next.ServeHTTP(rw, r)
 	})
 }
 
+func (lm *LatencyMiddlewareNormal) sample(_ *expressionParameters) (time.Duration, error) {
+	return lm.clamp(time.Duration(rand.NormFloat64()*float64(lm.stddev)) + lm.mean), nil
+}
+
 type LatencyMiddlewareExpression struct {
+	latencyBounds
+
 	mean   *govaluate.EvaluableExpression
 	stddev *govaluate.EvaluableExpression
+	replay *replay
 
 	activeRequests  uint32
 	serverStartTime time.Time
 }
 
-func NewLatencyMiddlewareExpression(mean string, stddev string) (*LatencyMiddlewareExpression, error) {
+func NewLatencyMiddlewareExpression(mean string, stddev string, replay *replay) (*LatencyMiddlewareExpression, error) {
 	meanExpression, err := govaluate.NewEvaluableExpressionWithFunctions(mean, expressionFunctions)
 	if err != nil {
 		return nil, fmt.Errorf("could not use mean expression: %s", err)
@@ -51,10 +100,18 @@ func NewLatencyMiddlewareExpression(mean string, stddev string) (*LatencyMiddlew
 	return &LatencyMiddlewareExpression{
 		mean:            meanExpression,
 		stddev:          stddevExpression,
+		replay:          replay,
 		serverStartTime: time.Now(),
 	}, nil
 }
 
+func (lm *LatencyMiddlewareExpression) startAt(start time.Time) {
+	lm.serverStartTime = start
+	if lm.replay != nil {
+		lm.replay.start = start
+	}
+}
+
 func (lm *LatencyMiddlewareExpression) WrapHTTP(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		atomic.AddUint32(&lm.activeRequests, 1)
@@ -70,45 +127,85 @@ func (lm *LatencyMiddlewareExpression) WrapHTTP(next http.Handler) http.Handler
 			t:              time.Now().Sub(lm.serverStartTime),
 		}
 
-		v, err := lm.mean.Eval(parameters)
+		d, err := lm.sample(parameters)
 		if err != nil {
-			errFn(fmt.Errorf("cannot evaluate mean expression: %s", err))
+			errFn(err)
 			return
 		}
 
-		var mean float64
-		switch v := v.(type) {
-		case float64:
-			mean = v
-		default:
-			errFn(fmt.Errorf("mean expression did not return a float64, returned: %T", v))
+		if !sleepLatency(r, d) {
 			return
 		}
+		next.ServeHTTP(rw, r)
+	})
+}
 
-		v, err = lm.stddev.Eval(parameters)
-		if err != nil {
-			errFn(fmt.Errorf("cannot evaluate stddev expression: %s", err))
-			return
-		}
+// sleepLatency injects latency d into r, recording it in its details, and
+// returns whether the client of r was still there after it. Negative
+// latencies are injected as none.
+func sleepLatency(r *http.Request, d time.Duration) bool {
+	if d < 0 {
+		d = 0
+	}
+	detailsFromRequest(r).setLatency(d)
+	return sleepRequest(r, d)
+}
 
-		var stddev float64
-		switch v := v.(type) {
-		case float64:
-			stddev = v
-		default:
-			errFn(fmt.Errorf("mean expression did not return a float64, returned: %T", v))
-			return
-		}
+func (lm *LatencyMiddlewareExpression) sample(parameters *expressionParameters) (time.Duration, error) {
+	mean, stddev, err := lm.evaluate(parameters)
+	if err != nil {
+		return 0, err
+	}
 
-		d := time.Duration(rand.NormFloat64()*stddev+mean) * time.Millisecond
-		time.Sleep(d)
-		next.ServeHTTP(rw, r)
-	})
+	return lm.clamp(duration((rand.NormFloat64()*stddev + mean) * float64(time.Millisecond))), nil
+}
+
+// evaluate returns the mean and standard deviation, in ms, of the latency of a
+// request given parameters.
+func (lm *LatencyMiddlewareExpression) evaluate(parameters *expressionParameters) (float64, float64, error) {
+	parameters = parameters.withReplay(lm.replay)
+
+	v, err := lm.mean.Eval(parameters)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot evaluate mean expression: %s", err)
+	}
+
+	var mean float64
+	switch v := v.(type) {
+	case float64:
+		mean = v
+	default:
+		return 0, 0, fmt.Errorf("mean expression did not return a float64, returned: %T", v)
+	}
+
+	v, err = lm.stddev.Eval(parameters)
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot evaluate stddev expression: %s", err)
+	}
+
+	var stddev float64
+	switch v := v.(type) {
+	case float64:
+		stddev = v
+	default:
+		return 0, 0, fmt.Errorf("stddev expression did not return a float64, returned: %T", v)
+	}
+
+	return mean, stddev, nil
 }
 
 type LatencyDistribution string
 
 const (
-	LatencyDistributionNormal   = LatencyDistribution("NORMAL")
-	LatencyDistributionFunction = LatencyDistribution("EXPRESSION")
+	LatencyDistributionNormal      = LatencyDistribution("NORMAL")
+	LatencyDistributionFunction    = LatencyDistribution("EXPRESSION")
+	LatencyDistributionConstant    = LatencyDistribution("CONSTANT")
+	LatencyDistributionUniform     = LatencyDistribution("UNIFORM")
+	LatencyDistributionExponential = LatencyDistribution("EXPONENTIAL")
+	LatencyDistributionLognormal   = LatencyDistribution("LOGNORMAL")
+	LatencyDistributionPareto      = LatencyDistribution("PARETO")
+	LatencyDistributionWeibull     = LatencyDistribution("WEIBULL")
+	LatencyDistributionMixture     = LatencyDistribution("MIXTURE")
+	LatencyDistributionPercentiles = LatencyDistribution("PERCENTILES")
+	LatencyDistributionEmpirical   = LatencyDistribution("EMPIRICAL")
 )
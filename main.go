@@ -2,14 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -19,148 +18,132 @@ import (
 )
 
 type parameters struct {
-	Address string `json:"address"`
+	Address      string  `json:"address"`
+	AdminAddress *string `json:"admin_address,omitempty"`
+	Config       *string `json:"config,omitempty"`
 
-	LatencyDistribution                        string  `json:"latency_distribution"`
-	LatencyDistributionNormalMean              *string `json:"latency_distribution_normal_mean,omitempty"`
-	LatencyDistributionNormalStandardDeviation *string `json:"latency_distribution_normal_standard_deviation,omitempty"`
+	TLS   *tlsParameters   `json:"tls,omitempty"`
+	HTTP2 *http2Parameters `json:"http2,omitempty"`
 
-	LatencyDistributionExpressionMean              *string `json:"latency_distribution_expression_mean,omitempty"`
-	LatencyDistributionExpressionStandardDeviation *string `json:"latency_distribution_expression_standard_deviation,omitempty"`
+	Connection      *connectionParameters      `json:"connection,omitempty"`
+	ConnectionLimit *connectionLimitParameters `json:"connection_limit,omitempty"`
+	ProxyProtocol   bool                       `json:"proxy_protocol,omitempty"`
+	Drain           *drainParameters           `json:"drain,omitempty"`
+	Health          *healthParameters          `json:"health,omitempty"`
+	AccessLog       *accessLogParameters       `json:"access_log,omitempty"`
+	RequestBody     *requestBodyParameters     `json:"request_body,omitempty"`
+	Timeouts        *timeoutsParameters        `json:"timeouts,omitempty"`
 
-	ErrorExpression *string `json:"error_expression,omitempty"`
+	profileParameters
 
-	RateLimitBehavior           string  `json:"rate_limit_behavior"`
-	RateLimitBucketFillInterval *string `json:"rate_limit_bucket_fill_interval,omitempty"`
-	RateLimitBucketCapacity     *int64  `json:"rate_limit_bucket_capaticy,omitempty"`
-	RateLimitBucketQuauntum     *int64  `json:"rate_limit_bucket_quantum,omitempty"`
-	RateLimitHardStatusCode     *int    `json:"rate_limit_hard_status_code,omitempty"`
+	Routes []routeParameters `json:"routes,omitempty"`
+}
+
+// buildServerOptions builds the options of the server described by v along
+// with the parameters to report for them.
+func buildServerOptions(v *viper.Viper) ([]func(*ServerOptions), *parameters, error) {
+	profile, err := buildProfile(v)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := profile.options
+
+	parameters := &parameters{
+		profileParameters: profile.parameters,
+	}
+
+	routes, routeParameters, err := buildRoutes(v)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, route := range routes {
+		opts = append(opts, WithRoute(route.Path, route.Methods, route.Options...))
+	}
+	parameters.Routes = routeParameters
+
+	return opts, parameters, nil
 }
 
 var rootCmd = &cobra.Command{
 	Use:   "http_test_server",
 	Short: "A simple HTTP server useful for testing.",
 	Long:  "This is used in Vector's test harness to test and benchmark HTTP performance. https://github.com/timberio/vector-test-harness",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return loadConfig(viper.GetViper())
+	},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		summaryPath := viper.GetString("summary-path")
 		os.Remove(summaryPath)
 
 		parametersPath := viper.GetString("parameters-path")
 
-		opts := []func(*ServerOptions){}
-
-		parameters := &parameters{}
-
-		latencyDistribution := viper.GetString("latency-distribution")
-		parameters.LatencyDistribution = latencyDistribution
-		switch latencyDistribution {
-		case "NORMAL":
-			mean := viper.GetDuration("latency-normal-mean")
-			stddev := viper.GetDuration("latency-normal-stddev")
-			parameters.LatencyDistributionNormalMean = func() *string {
-				s := mean.String()
-				return &s
-			}()
-			parameters.LatencyDistributionNormalStandardDeviation = func() *string {
-				s := stddev.String()
-				return &s
-			}()
-			opts = append(opts, WithLatency(NewLatencyMiddlewareNormal(mean, stddev)))
-		case "EXPRESSION":
-			mean := viper.GetString("latency-expression-mean-ms")
-			parameters.LatencyDistributionExpressionMean = &mean
-
-			stddev := viper.GetString("latency-expression-stddev-ms")
-			parameters.LatencyDistributionExpressionStandardDeviation = &stddev
-
-			middleware, err := NewLatencyMiddlewareExpression(mean, stddev)
-			if err != nil {
-				return fmt.Errorf("latency expression error: %s", err)
-			}
-
-			opts = append(opts, WithLatency(middleware))
-		default:
-			return fmt.Errorf("unknown latency-distribution value: %s", latencyDistribution)
+		names, configs, err := serverConfigs(viper.GetViper())
+		if err != nil {
+			return err
 		}
 
-		behavior := viper.GetString("rate-limit-behavior")
-		if behavior != "NONE" {
-			var (
-				fillInterval = viper.GetDuration("rate-limit-bucket-fill-interval")
-				capacity     = viper.GetInt64("rate-limit-bucket-capacity")
-				quantum      = viper.GetInt64("rate-limit-bucket-quantum")
-			)
-
-			if fillInterval <= 0 {
-				return fmt.Errorf("--rate-limit-bucket-fill-interval must be > 0 if --rate-limit-behavior is set to not NONE")
-			}
-			if capacity <= 0 {
-				return fmt.Errorf("--rate-limit-bucket-capacity must be > 0 if --rate-limit-behavior is set to not NONE")
-			}
-			if quantum <= 0 {
-				return fmt.Errorf("--rate-limit-bucket-quantum must be > 0 if --rate-limit-behavior is set to not NONE")
+		// the certificate authority is only generated if a server needs a
+		// certificate, and shared by all of them
+		var authority *certificateAuthority
+		ca := func() (*certificateAuthority, error) {
+			if authority != nil {
+				return authority, nil
 			}
 
-			var rateLimiter RateLimiter
-			switch behavior {
-			case "HARD":
-				code := viper.GetInt("rate-limit-hard-status-code")
-				rateLimiter = NewRateLimiterHard(fillInterval, capacity, quantum, code)
-				parameters.RateLimitHardStatusCode = &code
-			case "QUEUE":
-				rateLimiter = NewRateLimiterQueue(fillInterval, capacity, quantum)
-			case "CLOSE":
-				rateLimiter = NewRateLimiterClose(fillInterval, capacity, quantum)
-			default:
-				return fmt.Errorf("unknown rate-limit-behavior value: %s", behavior)
+			dir := filepath.Dir(parametersPath)
+			if parametersPath == "" {
+				tmp, err := ioutil.TempDir("", "http_test_server")
+				if err != nil {
+					return nil, err
+				}
+				dir = tmp
 			}
 
-			parameters.RateLimitBucketFillInterval = func() *string {
-				s := fillInterval.String()
-				return &s
-			}()
-			parameters.RateLimitBucketCapacity = &capacity
-			parameters.RateLimitBucketQuauntum = &quantum
-
-			opts = append(opts, WithRateLimiter(rateLimiter))
-		}
-
-		parameters.RateLimitBehavior = behavior
-
-		if expression := viper.GetString("error-expression"); expression != "" {
-			middleware, err := NewErrorExpressionMiddleware(expression)
+			a, err := newCertificateAuthority(dir)
 			if err != nil {
-				return fmt.Errorf("error expression error: %s", err)
+				return nil, err
 			}
-
-			parameters.ErrorExpression = &expression
-
-			opts = append(opts, WithError(middleware))
+			authority = a
+			log.Printf("Wrote TLS certificate authority to %s", authority.CAFile())
+			return authority, nil
 		}
 
-		listener, err := net.Listen("tcp", viper.GetString("address"))
-		if err != nil {
-			return fmt.Errorf("coulld not bind to address: %s", err)
+		servers := []*virtualServer{}
+		for i, name := range names {
+			vs, err := newVirtualServer(name, configs[i], ca)
+			if err != nil {
+				return err
+			}
+			if vs.summaryPath != summaryPath {
+				os.Remove(vs.summaryPath)
+			}
+			servers = append(servers, vs)
 		}
 
-		parameters.Address = listener.Addr().String()
-
 		if parametersPath != "" {
-			b, err := json.Marshal(parameters)
-			if err != nil {
-				log.Fatal(err)
+			var config *string
+			if c := viper.ConfigFileUsed(); c != "" {
+				config = &c
 			}
 
-			err = ioutil.WriteFile(parametersPath, b, 0644)
+			err = writeParameters(parametersPath, config, servers)
 			if err != nil {
 				log.Fatal(err)
 			}
 		}
 
-		server := NewServer(opts...)
-
 		done := make(chan struct{})
 
+		if viper.ConfigFileUsed() != "" {
+			err := watchConfig(viper.GetViper(), done, func() error {
+				return reloadServers(viper.GetViper(), servers)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
 		go func() {
 			var gracefulStop = make(chan os.Signal, 1)
 			signal.Notify(gracefulStop, syscall.SIGTERM)
@@ -169,33 +152,22 @@ var rootCmd = &cobra.Command{
 			sig := <-gracefulStop
 			log.Printf("Caught sig: %+v", sig)
 
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancel()
-
-			if err := server.Shutdown(ctx); err != nil {
-				// Error from closing listeners, or context timeout:
+			if err := shutdownServers(context.Background(), servers); err != nil {
+				// Error from closing listeners, or drain timeout; the
+				// summary is written regardless
 				log.Printf("could not gracefully shutdown the server: %v\n", err)
-				return
-			}
-
-			sBytes, err := json.Marshal(server.Statistics())
-			if err != nil {
-				log.Fatal(err)
 			}
 
-			err = ioutil.WriteFile(summaryPath, sBytes, 0644)
-			if err != nil {
+			if err := writeSummaries(summaryPath, servers); err != nil {
 				log.Fatal(err)
 			}
 
-			fmt.Printf("Wrote activity summary to %s\n", summaryPath)
-
 			close(done)
 		}()
 
-		go func() {
-			server.Listen(listener)
-		}()
+		for _, vs := range servers {
+			vs.Listen()
+		}
 
 		<-done
 
@@ -204,16 +176,111 @@ var rootCmd = &cobra.Command{
 }
 
 func main() {
+	rootCmd.PersistentFlags().StringP("config", "C", "", "scenario file (YAML, TOML or JSON) describing the server options as a nested document\nFlags and HTTP_TEST_* environment variables take precedence over it")
 	rootCmd.PersistentFlags().StringP("address", "a", "0.0.0.0:8080", "the address to bind to")
 
-	rootCmd.PersistentFlags().StringP("latency-distribution", "l", "NORMAL", "distribution of artificial latency\nOne of [NORMAL,EXPRESSION]")
+	rootCmd.PersistentFlags().String("admin-address", "", "additional address to serve the admin API on; it is always served under /_admin on --address")
+
+	rootCmd.PersistentFlags().Bool("tls", false, "serve over TLS; a certificate is generated from an ephemeral CA, written next to the parameters file as ca.pem, unless --tls-cert-file and --tls-key-file are given")
+	rootCmd.PersistentFlags().String("tls-cert-file", "", "PEM certificate (chain) to serve over TLS with")
+	rootCmd.PersistentFlags().String("tls-key-file", "", "PEM private key of --tls-cert-file")
+	rootCmd.PersistentFlags().String("tls-client-auth", "NONE", "client certificate policy over TLS\nOne of [NONE, REQUEST, REQUIRE].\nNONE does not ask for one.\nREQUEST verifies one if given.\nREQUIRE rejects clients without a valid one (mutual TLS).\nUnless --tls-client-ca-file is given, client certificates are verified against the ephemeral CA, which issues one written as client.pem and client-key.pem")
+	rootCmd.PersistentFlags().String("tls-client-ca-file", "", "PEM CA certificates to verify client certificates with")
+
+	rootCmd.PersistentFlags().Bool("http2", false, "serve HTTP/2 in addition to HTTP/1.x: negotiated through ALPN over TLS, and as h2c (prior knowledge or Upgrade) otherwise")
+	rootCmd.PersistentFlags().Uint32("http2-max-concurrent-streams", 250, "maximum number of concurrent HTTP/2 streams per connection")
+
+	rootCmd.PersistentFlags().Uint32("connection-max-requests", 0, "close each connection after this many requests, by responding with Connection: close (a GOAWAY over HTTP/2); 0 for no limit")
+	rootCmd.PersistentFlags().Float64("connection-close-probability", 0, "probability of closing the connection after each request, by responding with Connection: close (a GOAWAY over HTTP/2)")
+	rootCmd.PersistentFlags().Duration("connection-idle-kill-after", 0, "close connections idle for this long, regardless of the idle timeout advertised to clients; 0 to leave them open")
+	rootCmd.PersistentFlags().Bool("connection-abortive-close", false, "close connections closed by a fault, including the CLOSE error expression result and rate limit behavior, with a TCP RST rather than a FIN")
+	rootCmd.PersistentFlags().Int("connection-limit-max", 0, "maximum number of connections served at once; 0 for no limit")
+	rootCmd.PersistentFlags().String("connection-limit-behavior", "STOP", "behavior when --connection-limit-max connections are open\nOne of [STOP, CLOSE, HOLD].\nSTOP stops accepting connections, leaving them in the kernel backlog.\nCLOSE accepts connections and closes them immediately.\nHOLD accepts connections and leaves them unread until there is capacity.")
+
+	rootCmd.PersistentFlags().Bool("proxy-protocol", false, "expect each connection to start with a PROXY protocol (version 1 or 2) header, as sent by a load balancer in front of the server, and use the client address it carries in logs, statistics and rate limit keys; connections without one are closed")
+
+	rootCmd.PersistentFlags().Duration("drain-timeout", 30*time.Second, "maximum duration of the drain on shutdown; requests still in flight after it are aborted, and the summary is written regardless")
+	rootCmd.PersistentFlags().Duration("drain-health-delay", 0, "how long /_health responds with 503 on shutdown before new requests are rejected, while they are still served as usual")
+	rootCmd.PersistentFlags().String("drain-behavior", "CLOSE", "how new requests are rejected while draining, after --drain-health-delay\nOne of [NONE, CLOSE, RETRY_AFTER].\nNONE serves them as usual until the listener is closed.\nCLOSE responds with 503 and Connection: close (a GOAWAY over HTTP/2).\nRETRY_AFTER responds with 503 and a Retry-After header of --drain-retry-after.")
+	rootCmd.PersistentFlags().Duration("drain-reject-delay", 0, "how long new requests are rejected according to --drain-behavior before the listener is closed and in-flight requests are waited for")
+	rootCmd.PersistentFlags().Duration("drain-retry-after", 5*time.Second, "delay advertised in the Retry-After header; only applies when drain-behavior is RETRY_AFTER")
+
+	rootCmd.PersistentFlags().String("health-path", "/_health", "path of the health check endpoint, e.g. for sink healthchecks; it fails while the server is draining, during --health-unhealthy-windows, while flapping and when --health-expression says so")
+	rootCmd.PersistentFlags().String("health-method", "", "only method accepted by the health check endpoints, e.g. GET; others get a 405 (default: any)")
+	rootCmd.PersistentFlags().Int("health-healthy-status", http.StatusNoContent, "status code health check endpoints respond with when healthy")
+	rootCmd.PersistentFlags().Int("health-unhealthy-status", http.StatusServiceUnavailable, "status code health check endpoints respond with when unhealthy")
+	rootCmd.PersistentFlags().String("health-expression", "", "expression to evaluate to determine if the server is healthy; variables: [active_requests, t]\nIt is expected to return one of:\ntrue if the server is healthy\nfalse if it is not\nan integer value if the health check should respond with the given HTTP status code")
+	rootCmd.PersistentFlags().String("health-unhealthy-windows", "", "JSON list of windows in which the server is unhealthy, each with a start offset and an optional duration, e.g.\n[{\"start\": \"1m\", \"duration\": \"30s\"}]")
+	rootCmd.PersistentFlags().Duration("health-flap-healthy", 0, "flap between healthy for this long and unhealthy for --health-flap-unhealthy; both must be set")
+	rootCmd.PersistentFlags().Duration("health-flap-unhealthy", 0, "flap between healthy for --health-flap-healthy and unhealthy for this long; both must be set")
+	rootCmd.PersistentFlags().String("health-liveness-path", "/_live", "path of the liveness endpoint, which only fails until the server listens; empty to disable it")
+	rootCmd.PersistentFlags().String("health-readiness-path", "/_ready", "path of the readiness endpoint, which fails for --health-readiness-delay and then like the health check endpoint; empty to disable it")
+	rootCmd.PersistentFlags().Duration("health-readiness-delay", 0, "how long the readiness endpoint fails after the server starts listening")
+
+	rootCmd.PersistentFlags().String("access-log-format", "TEXT", "format of the access log\nOne of [TEXT, JSON, LOGFMT].\nTEXT logs the request ID, method, path, remote address and user agent.\nJSON and LOGFMT also log the status, duration, body bytes, message count and the injected latency, rate limit decision, error expression result and client abort of each request.")
+	rootCmd.PersistentFlags().String("access-log-path", "", "file to append the access log to (default: standard output)")
+	rootCmd.PersistentFlags().Float64("access-log-sample-rate", 1, "fraction of requests written to the access log, between 0 and 1")
+
+	rootCmd.PersistentFlags().Duration("read-timeout", 5*time.Second, "how long the server reads each request for, headers and body; 0 for no timeout")
+	rootCmd.PersistentFlags().Duration("write-timeout", 10*time.Second, "how long the server handles each request for, from the end of its headers to the end of its response, latency included; 0 for no timeout")
+	rootCmd.PersistentFlags().Duration("idle-timeout", 15*time.Second, "how long idle keep-alive connections are kept open; 0 for the read timeout")
+
+	rootCmd.PersistentFlags().Int64("request-body-rate", 0, "bytes per second request bodies are read at, so that clients stall writing them (default: as fast as they come)")
+	rootCmd.PersistentFlags().Bool("request-body-shared", false, "whether --request-body-rate is shared by all requests of the server rather than applying to each of them")
+	rootCmd.PersistentFlags().Int64("request-body-pause-after", 0, "bytes of each request body read before reading pauses for --request-body-pause")
+	rootCmd.PersistentFlags().Duration("request-body-pause", 0, "how long reading each request body pauses once --request-body-pause-after bytes have been read")
+
+	rootCmd.PersistentFlags().StringP("latency-distribution", "l", "NORMAL", "distribution of artificial latency\nOne of [NORMAL,EXPRESSION,CONSTANT,UNIFORM,EXPONENTIAL,LOGNORMAL,PARETO,WEIBULL,MIXTURE,PERCENTILES,EMPIRICAL]")
 	rootCmd.PersistentFlags().DurationP("latency-normal-mean", "m", 0, "artificial latency to inject; only applies when latency-distribution is NORMAL (default: 0)")
 	rootCmd.PersistentFlags().DurationP("latency-normal-stddev", "S", 0, "standard deviation of artificial latency to inject; only applies when latency-distribution is NORMAL (default: 0)")
 
 	rootCmd.PersistentFlags().String("latency-expression-mean-ms", "0", "expression to use to evaluate latency of request in ms; variables: [active_requests]; only applies when latency-distribution is EXPRESSION (default: '0')")
 	rootCmd.PersistentFlags().String("latency-expression-stddev-ms", "0", "expression to use to evaluate stddev of the latency of request in ms; variables: [active_requests]; only applies when latency-distribution is EXPRESSION (default: '0')")
 
-	rootCmd.PersistentFlags().StringP("error-expression", "e", "", "expression to evaluate to determine if the request should error; variables: [active_requests]\nIt is expected to return one of:\nfalse if the request should not error\ntrue if the request should error with 500\nan integer value if the request should error with the given HTTP status code\nthe string CLOSE if the request should error by simply closing the connection")
+	rootCmd.PersistentFlags().Duration("latency-constant-value", 0, "artificial latency to inject; only applies when latency-distribution is CONSTANT (default: 0)")
+
+	rootCmd.PersistentFlags().Duration("latency-uniform-min", 0, "lowest artificial latency to inject; only applies when latency-distribution is UNIFORM (default: 0)")
+	rootCmd.PersistentFlags().Duration("latency-uniform-max", 0, "highest artificial latency to inject; only applies when latency-distribution is UNIFORM (default: 0)")
+
+	rootCmd.PersistentFlags().Duration("latency-exponential-mean", 0, "mean of artificial latency to inject; only applies when latency-distribution is EXPONENTIAL (default: 0)")
+
+	rootCmd.PersistentFlags().Duration("latency-lognormal-median", 0, "median of artificial latency to inject; only applies when latency-distribution is LOGNORMAL (default: 0)")
+	rootCmd.PersistentFlags().Float64("latency-lognormal-sigma", 0, "standard deviation of the logarithm of artificial latency to inject; the higher, the longer the tail; only applies when latency-distribution is LOGNORMAL (default: 0)")
+
+	rootCmd.PersistentFlags().Duration("latency-pareto-scale", 0, "lowest artificial latency to inject; only applies when latency-distribution is PARETO (default: 0)")
+	rootCmd.PersistentFlags().Float64("latency-pareto-shape", 1, "shape of the tail of artificial latency to inject; the lower, the heavier the tail; only applies when latency-distribution is PARETO")
+
+	rootCmd.PersistentFlags().Duration("latency-weibull-scale", 0, "scale of artificial latency to inject; only applies when latency-distribution is WEIBULL (default: 0)")
+	rootCmd.PersistentFlags().Float64("latency-weibull-shape", 1, "shape of artificial latency to inject; below 1 the tail is heavier than exponential, above 1 lighter; only applies when latency-distribution is WEIBULL")
+
+	rootCmd.PersistentFlags().String("latency-mixture", "", "JSON list of latency distributions to draw from at random by weight; only applies when latency-distribution is MIXTURE, e.g.\n[{\"weight\": 0.95, \"distribution\": \"LOGNORMAL\", \"lognormal\": {\"median\": \"20ms\", \"sigma\": 0.3}}, {\"weight\": 0.05, \"distribution\": \"CONSTANT\", \"constant\": {\"value\": \"2s\"}}]")
+
+	rootCmd.PersistentFlags().Duration("latency-percentiles-p50", 0, "target median of artificial latency to inject; only applies when latency-distribution is PERCENTILES, which fits a distribution to at least two of the target percentiles (default: unset)")
+	rootCmd.PersistentFlags().Duration("latency-percentiles-p90", 0, "target p90 of artificial latency to inject; only applies when latency-distribution is PERCENTILES (default: unset)")
+	rootCmd.PersistentFlags().Duration("latency-percentiles-p99", 0, "target p99 of artificial latency to inject; only applies when latency-distribution is PERCENTILES (default: unset)")
+	rootCmd.PersistentFlags().Duration("latency-percentiles-p999", 0, "target p99.9 of artificial latency to inject; only applies when latency-distribution is PERCENTILES (default: unset)")
+
+	rootCmd.PersistentFlags().String("latency-empirical-path", "", "CSV or JSON file of latency samples or histogram buckets to draw artificial latency from, interpolating within buckets; only applies when latency-distribution is EMPIRICAL")
+	rootCmd.PersistentFlags().Bool("latency-empirical-cumulative", false, "whether the counts of the histogram buckets of --latency-empirical-path include those of the previous buckets, as in Prometheus histograms")
+
+	rootCmd.PersistentFlags().Duration("latency-min", 0, "lowest artificial latency to inject, whatever the distribution; latencies drawn below it are raised to it (default: 0)")
+	rootCmd.PersistentFlags().Duration("latency-max", 0, "highest artificial latency to inject, whatever the distribution; latencies drawn above it are lowered to it (default: none)")
+
+	rootCmd.PersistentFlags().StringP("error-expression", "e", "", "expression to evaluate to determine if the request should error; variables: [active_requests]\nIt is expected to return one of:\nfalse if the request should not error\ntrue if the request should error with 500\nan integer value if the request should error with the given HTTP status code\nthe string CLOSE if the request should error by simply closing the connection (over HTTP/2: sending the headers of a 503 with a GOAWAY, letting other streams complete, and resetting its stream)\nthe string RESET if the request should error by resetting its stream (over HTTP/1.x: closing the connection)")
+
+	rootCmd.PersistentFlags().Int64("response-body-size", 0, "size in bytes of the body of responses, streamed with chunked encoding; 0 for an empty 204")
+	rootCmd.PersistentFlags().Duration("response-ttfb", 0, "delay before the status and headers of responses are sent, after the artificial latency")
+	rootCmd.PersistentFlags().Int64("response-rate", 0, "bytes per second the body of responses is trickled at (default: as fast as possible)")
+	rootCmd.PersistentFlags().Duration("response-flush-interval", 100*time.Millisecond, "how often the body of responses is flushed while it is trickled at --response-rate")
+
+	rootCmd.PersistentFlags().String("replay-path", "", "CSV or JSON file of a time series to replay, each row with an offset and any of a latency, latency_stddev, error_rate and request_rate, interpolated between rows\nLatency and error expressions can refer to its values as [replay_latency_ms, replay_latency_stddev_ms, replay_error_rate, replay_request_rate], and rate limit buckets fill at its request rate.")
+	rootCmd.PersistentFlags().String("replay-end", "LOOP", "what happens at the end of the replay\nOne of [LOOP, STOP].\nLOOP starts it over; STOP keeps the values of its last row.")
+
+	rootCmd.PersistentFlags().String("routes", "", "JSON list of additional routes, each with a path, an optional list of methods and its own latency, error and rate-limit settings, e.g.\n[{\"path\": \"/slow\", \"methods\": [\"POST\"], \"latency\": {\"normal\": {\"mean\": \"2s\"}}}]")
+
+	rootCmd.PersistentFlags().String("phases", "", "JSON list of phases, each with a start offset, an optional name and duration and its own latency, error and rate-limit settings replacing the top-level ones while it is active, e.g.\n[{\"name\": \"limited\", \"start\": \"20s\", \"duration\": \"30s\", \"rate-limit\": {\"behavior\": \"HARD\", ...}}]")
+
+	rootCmd.PersistentFlags().String("servers", "", "JSON list of virtual servers to run instead of a single one, each with a name, an address and its own options, e.g.\n[{\"name\": \"healthy\", \"address\": \"0.0.0.0:8081\"}, {\"name\": \"degraded\", \"address\": \"0.0.0.0:8082\", \"error\": {\"expression\": \"503\"}}]")
 
 	rootCmd.PersistentFlags().StringP("summary-path", "s", "/tmp/http_test_server_summary.json", "file to write out statistics summary to")
 	rootCmd.PersistentFlags().StringP("parameters-path", "p", "", "file to write out test parameters to")
@@ -221,12 +288,35 @@ func main() {
 	rootCmd.PersistentFlags().UintP("rate-limit-bucket-capacity", "c", 0, "rate limit token bucket capacity (max tokens) (default: 0)")
 	rootCmd.PersistentFlags().UintP("rate-limit-bucket-quantum", "q", 0, "rate limit token bucket quantum (tokens added per interval) (default: 0)")
 	rootCmd.PersistentFlags().DurationP("rate-limit-bucket-fill-interval", "d", 0, "interval to refill quantum number of tokens (default: 0)")
-	rootCmd.PersistentFlags().StringP("rate-limit-behavior", "b", "NONE", "behavior of rate limiter\nOne of [HARD, QUEUE, CLOSE, NONE].\nHARD returns 429s when limit is hit.\nQUEUE queues the request.\nCLOSE terminates the connection early\nNONE applies no limit.")
+	rootCmd.PersistentFlags().StringP("rate-limit-behavior", "b", "NONE", "behavior of rate limiter\nOne of [HARD, QUEUE, CLOSE, RESET, NONE].\nHARD returns 429s when limit is hit.\nQUEUE queues the request.\nCLOSE terminates the connection early; over HTTP/2 it sends the headers of a 503 with a GOAWAY, letting other streams complete, and resets the stream.\nRESET resets the stream of the request over HTTP/2, and terminates the connection over HTTP/1.x.\nNONE applies no limit.")
+	rootCmd.PersistentFlags().String("rate-limit-key", "GLOBAL", "what requests share a rate limit\nOne of [GLOBAL, CLIENT].\nGLOBAL limits all requests together.\nCLIENT limits the requests of each client address separately, as given by the PROXY protocol header if --proxy-protocol is set.")
 	rootCmd.PersistentFlags().Int("rate-limit-hard-status-code", http.StatusTooManyRequests, "status code to return for rate limit; only applies if rate-limit-behavior is HARD")
 
-	viper.BindPFlags(rootCmd.PersistentFlags())
+	ctlCmd.PersistentFlags().String("admin-url", "", "base URL of the admin API, e.g. http://localhost:8080 (default: derived from admin-address or address, over https if --tls is given and admin-address is not set; the server is trusted through tls-cert-file, or the CA generated next to parameters-path, and tls-client-ca-file)")
+	ctlSetCmd.Flags().String("route", "/", "path of the route to change")
+	ctlCmd.AddCommand(ctlGetCmd, ctlSetCmd)
+	rootCmd.AddCommand(ctlCmd)
+
+	validateCmd.Flags().UintSlice("active-requests", []uint{1, 2, 5, 10, 20, 50, 100, 500}, "values of active_requests to evaluate expressions at")
+	validateCmd.Flags().DurationSlice("t", []time.Duration{0, time.Second, 10 * time.Second, 30 * time.Second, time.Minute, 2 * time.Minute, 5 * time.Minute, 10 * time.Minute}, "values of t to evaluate expressions at")
+	validateCmd.Flags().Int("samples", 10, "number of times to evaluate expressions at each point, to account for rand()")
+	rootCmd.AddCommand(validateCmd)
+
+	simulateCmd.Flags().Uint("active-requests-min", 1, "lowest value of active_requests to simulate")
+	simulateCmd.Flags().Uint("active-requests-max", 50, "highest value of active_requests to simulate")
+	simulateCmd.Flags().Uint("active-requests-step", 1, "step between simulated values of active_requests")
+	simulateCmd.Flags().Duration("t-max", 10*time.Minute, "highest value of t to simulate; t starts at 0")
+	simulateCmd.Flags().Duration("t-step", 30*time.Second, "step between simulated values of t")
+	simulateCmd.Flags().Int("samples", 1000, "number of samples to draw at each point")
+	rootCmd.AddCommand(simulateCmd)
+
+	configCmd.AddCommand(configDumpCmd)
+	rootCmd.AddCommand(configCmd)
+
+	bindFlags(viper.GetViper(), rootCmd.PersistentFlags())
+	bindFlags(viper.GetViper(), ctlCmd.PersistentFlags())
 
-	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 	viper.SetEnvPrefix("HTTP_TEST")
 	viper.AutomaticEnv()
 
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Phase overrides the latency, error and rate limit behavior of a route for
+// Duration, starting Start after the server starts listening. A Duration of 0
+// lasts until the next phase starts, or forever.
+type Phase struct {
+	Name     string
+	Start    time.Duration
+	Duration time.Duration
+	Options  []func(*ServerOptions)
+}
+
+func WithPhase(phase Phase) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.Phases = append(s.Phases, phase)
+	}
+}
+
+type phaseParameters struct {
+	Name     string `json:"name"`
+	Start    string `json:"start"`
+	Duration string `json:"duration,omitempty"`
+
+	profileParameters
+}
+
+// buildPhases builds the phase timeline declared under the phases key of v.
+// Each phase has a start offset, an optional name and duration and the same
+// profile keys as the top-level configuration.
+func buildPhases(v *viper.Viper) ([]Phase, []phaseParameters, error) {
+	settings, err := getSettingsList(v, "phases")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	phases := []Phase{}
+	parameters := []phaseParameters{}
+	for i, s := range settings {
+		pv := newProfileViper(s)
+
+		name := pv.GetString("name")
+		if name == "" {
+			name = fmt.Sprintf("phase-%d", i)
+		}
+
+		if pv.IsSet("phases") {
+			return nil, nil, fmt.Errorf("phase %s: phases cannot be nested", name)
+		}
+
+		start := pv.GetDuration("start")
+		duration := pv.GetDuration("duration")
+		if start < 0 {
+			return nil, nil, fmt.Errorf("phase %s: start must be >= 0", name)
+		}
+		if duration < 0 {
+			return nil, nil, fmt.Errorf("phase %s: duration must be >= 0", name)
+		}
+
+		profile, err := buildProfile(pv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("phase %s: %s", name, err)
+		}
+
+		phases = append(phases, Phase{
+			Name:     name,
+			Start:    start,
+			Duration: duration,
+			Options:  profile.options,
+		})
+
+		phaseParameters := phaseParameters{
+			Name:              name,
+			Start:             start.String(),
+			profileParameters: profile.parameters,
+		}
+		if duration > 0 {
+			phaseParameters.Duration = duration.String()
+		}
+		parameters = append(parameters, phaseParameters)
+	}
+
+	return phases, parameters, nil
+}
+
+type mountedPhase struct {
+	Phase
+	handler     http.Handler
+	rateLimiter Middleware
+}
+
+// end returns the offset at which the phase ends, or 0 if it never does.
+func (p *mountedPhase) end() time.Duration {
+	if p.Duration == 0 {
+		return 0
+	}
+	return p.Start + p.Duration
+}
+
+// activePhase returns the phase of route active at offset, or nil if none is.
+// When phases overlap, the one that started last wins.
+func (route *mountedRoute) activePhase(offset time.Duration) *mountedPhase {
+	var active *mountedPhase
+	for _, phase := range route.phases {
+		if phase.Start > offset || (phase.end() != 0 && phase.end() <= offset) {
+			continue
+		}
+		if active == nil || phase.Start >= active.Start {
+			active = phase
+		}
+	}
+	return active
+}
+
+// runPhases swaps the pipeline of route at each phase boundary, relative to
+// start, until the server shuts down. Each boundary is recorded as an event.
+func (s *Server) runPhases(route *mountedRoute, start time.Time) {
+	boundaries := []time.Duration{}
+	for _, phase := range route.phases {
+		boundaries = append(boundaries, phase.Start)
+		if end := phase.end(); end != 0 {
+			boundaries = append(boundaries, end)
+		}
+	}
+	sort.Slice(boundaries, func(i, j int) bool {
+		return boundaries[i] < boundaries[j]
+	})
+
+	var active *mountedPhase
+	for _, boundary := range boundaries {
+		timer := time.NewTimer(time.Until(start.Add(boundary)))
+		select {
+		case <-timer.C:
+		case <-s.quit:
+			timer.Stop()
+			return
+		}
+
+		next := route.activePhase(boundary)
+		if next == active {
+			continue
+		}
+
+		now := time.Now().UTC()
+		if active != nil {
+			s.recordEvent(&Event{Time: now, Type: EventPhaseEnd, Route: route.path, Name: active.Name})
+		}
+		route.enterPhase(next)
+		if next != nil {
+			s.recordEvent(&Event{Time: now, Type: EventPhaseStart, Route: route.path, Name: next.Name})
+			s.logger.Printf("Route %s entered phase %s", route.path, next.Name)
+		} else {
+			s.logger.Printf("Route %s left phase %s", route.path, active.Name)
+		}
+		active = next
+	}
+}
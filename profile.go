@@ -0,0 +1,476 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// profileKeys maps the configuration keys describing a behavior profile
+// (latency, errors and rate limiting) to the flags that set them on the
+// command line. The same keys are used for the top-level profile and for the
+// profile of each route.
+var profileKeys = map[string]string{
+	"latency.distribution":            "latency-distribution",
+	"latency.normal.mean":             "latency-normal-mean",
+	"latency.normal.stddev":           "latency-normal-stddev",
+	"latency.expression.mean-ms":      "latency-expression-mean-ms",
+	"latency.expression.stddev-ms":    "latency-expression-stddev-ms",
+	"latency.constant.value":          "latency-constant-value",
+	"latency.uniform.min":             "latency-uniform-min",
+	"latency.uniform.max":             "latency-uniform-max",
+	"latency.exponential.mean":        "latency-exponential-mean",
+	"latency.lognormal.median":        "latency-lognormal-median",
+	"latency.lognormal.sigma":         "latency-lognormal-sigma",
+	"latency.pareto.scale":            "latency-pareto-scale",
+	"latency.pareto.shape":            "latency-pareto-shape",
+	"latency.weibull.scale":           "latency-weibull-scale",
+	"latency.weibull.shape":           "latency-weibull-shape",
+	"latency.mixture":                 "latency-mixture",
+	"latency.percentiles.p50":         "latency-percentiles-p50",
+	"latency.percentiles.p90":         "latency-percentiles-p90",
+	"latency.percentiles.p99":         "latency-percentiles-p99",
+	"latency.percentiles.p999":        "latency-percentiles-p999",
+	"latency.empirical.path":          "latency-empirical-path",
+	"latency.empirical.cumulative":    "latency-empirical-cumulative",
+	"latency.min":                     "latency-min",
+	"latency.max":                     "latency-max",
+	"error.expression":                "error-expression",
+	"response.body-size":              "response-body-size",
+	"response.ttfb":                   "response-ttfb",
+	"response.rate":                   "response-rate",
+	"response.flush-interval":         "response-flush-interval",
+	"replay.path":                     "replay-path",
+	"replay.end":                      "replay-end",
+	"rate-limit.behavior":             "rate-limit-behavior",
+	"rate-limit.hard-status-code":     "rate-limit-hard-status-code",
+	"rate-limit.key":                  "rate-limit-key",
+	"rate-limit.bucket.capacity":      "rate-limit-bucket-capacity",
+	"rate-limit.bucket.quantum":       "rate-limit-bucket-quantum",
+	"rate-limit.bucket.fill-interval": "rate-limit-bucket-fill-interval",
+}
+
+// profileDefaults holds the flag defaults of each profile key once the flags
+// are bound.
+var profileDefaults = map[string]string{}
+
+// newProfileViper returns a configuration for a single profile from settings,
+// falling back to the flag defaults for anything not set.
+func newProfileViper(settings map[string]interface{}) *viper.Viper {
+	v := viper.New()
+	for key, value := range profileDefaults {
+		v.SetDefault(key, value)
+	}
+	v.MergeConfigMap(settings)
+	return v
+}
+
+// profileSettings returns the profile keys of v as a nested document, in the
+// same shape as they are given in a config file.
+func profileSettings(v *viper.Viper) map[string]interface{} {
+	settings := map[string]interface{}{}
+	for key := range profileKeys {
+		value := v.Get(key)
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+
+		path := strings.Split(key, ".")
+		m := settings
+		for _, k := range path[:len(path)-1] {
+			if _, ok := m[k]; !ok {
+				m[k] = map[string]interface{}{}
+			}
+			m = m[k].(map[string]interface{})
+		}
+		m[path[len(path)-1]] = value
+	}
+	return settings
+}
+
+type latencyParameters struct {
+	LatencyDistribution                        string  `json:"latency_distribution"`
+	LatencyDistributionNormalMean              *string `json:"latency_distribution_normal_mean,omitempty"`
+	LatencyDistributionNormalStandardDeviation *string `json:"latency_distribution_normal_standard_deviation,omitempty"`
+
+	LatencyDistributionExpressionMean              *string `json:"latency_distribution_expression_mean,omitempty"`
+	LatencyDistributionExpressionStandardDeviation *string `json:"latency_distribution_expression_standard_deviation,omitempty"`
+
+	LatencyDistributionConstant        *string  `json:"latency_distribution_constant,omitempty"`
+	LatencyDistributionUniformMin      *string  `json:"latency_distribution_uniform_min,omitempty"`
+	LatencyDistributionUniformMax      *string  `json:"latency_distribution_uniform_max,omitempty"`
+	LatencyDistributionExponentialMean *string  `json:"latency_distribution_exponential_mean,omitempty"`
+	LatencyDistributionLognormalMedian *string  `json:"latency_distribution_lognormal_median,omitempty"`
+	LatencyDistributionLognormalSigma  *float64 `json:"latency_distribution_lognormal_sigma,omitempty"`
+	LatencyDistributionParetoScale     *string  `json:"latency_distribution_pareto_scale,omitempty"`
+	LatencyDistributionParetoShape     *float64 `json:"latency_distribution_pareto_shape,omitempty"`
+	LatencyDistributionWeibullScale    *string  `json:"latency_distribution_weibull_scale,omitempty"`
+	LatencyDistributionWeibullShape    *float64 `json:"latency_distribution_weibull_shape,omitempty"`
+
+	LatencyDistributionMixture []latencyMixtureParameters `json:"latency_distribution_mixture,omitempty"`
+
+	LatencyDistributionPercentilesP50  *string `json:"latency_distribution_percentiles_p50,omitempty"`
+	LatencyDistributionPercentilesP90  *string `json:"latency_distribution_percentiles_p90,omitempty"`
+	LatencyDistributionPercentilesP99  *string `json:"latency_distribution_percentiles_p99,omitempty"`
+	LatencyDistributionPercentilesP999 *string `json:"latency_distribution_percentiles_p999,omitempty"`
+
+	LatencyDistributionEmpiricalPath       *string  `json:"latency_distribution_empirical_path,omitempty"`
+	LatencyDistributionEmpiricalCumulative *bool    `json:"latency_distribution_empirical_cumulative,omitempty"`
+	LatencyDistributionEmpiricalCount      *float64 `json:"latency_distribution_empirical_count,omitempty"`
+	LatencyDistributionEmpiricalMin        *string  `json:"latency_distribution_empirical_min,omitempty"`
+	LatencyDistributionEmpiricalMax        *string  `json:"latency_distribution_empirical_max,omitempty"`
+	LatencyDistributionEmpiricalMean       *string  `json:"latency_distribution_empirical_mean,omitempty"`
+	LatencyDistributionEmpiricalP50        *string  `json:"latency_distribution_empirical_p50,omitempty"`
+	LatencyDistributionEmpiricalP90        *string  `json:"latency_distribution_empirical_p90,omitempty"`
+	LatencyDistributionEmpiricalP99        *string  `json:"latency_distribution_empirical_p99,omitempty"`
+	LatencyDistributionEmpiricalP999       *string  `json:"latency_distribution_empirical_p999,omitempty"`
+
+	LatencyMin *string `json:"latency_min,omitempty"`
+	LatencyMax *string `json:"latency_max,omitempty"`
+}
+
+type latencyMixtureParameters struct {
+	Weight float64 `json:"weight"`
+
+	latencyParameters
+}
+
+type profileParameters struct {
+	latencyParameters
+
+	Replay *replayParameters `json:"replay,omitempty"`
+
+	responseParameters
+
+	ErrorExpression *string `json:"error_expression,omitempty"`
+
+	RateLimitBehavior           string  `json:"rate_limit_behavior"`
+	RateLimitBucketFillInterval *string `json:"rate_limit_bucket_fill_interval,omitempty"`
+	RateLimitBucketCapacity     *int64  `json:"rate_limit_bucket_capaticy,omitempty"`
+	RateLimitBucketQuauntum     *int64  `json:"rate_limit_bucket_quantum,omitempty"`
+	RateLimitHardStatusCode     *int    `json:"rate_limit_hard_status_code,omitempty"`
+	RateLimitKey                string  `json:"rate_limit_key,omitempty"`
+
+	Phases []phaseParameters `json:"phases,omitempty"`
+}
+
+type profile struct {
+	options    []func(*ServerOptions)
+	parameters profileParameters
+}
+
+// buildProfile builds the latency, error and rate limit middlewares described
+// by v, along with its phase timeline.
+func buildProfile(v *viper.Viper) (*profile, error) {
+	profile := &profile{
+		options: []func(*ServerOptions){WithSettings(profileSettings(v))},
+	}
+	parameters := &profile.parameters
+
+	rp, replayParameters, err := buildReplay(v)
+	if err != nil {
+		return nil, err
+	}
+	parameters.Replay = replayParameters
+
+	latency, latencyParameters, err := buildLatency(v, rp, true)
+	if err != nil {
+		return nil, err
+	}
+	parameters.latencyParameters = *latencyParameters
+	profile.options = append(profile.options, WithLatency(latency))
+
+	behavior := v.GetString("rate-limit.behavior")
+	if behavior != "NONE" {
+		var (
+			fillInterval = v.GetDuration("rate-limit.bucket.fill-interval")
+			capacity     = v.GetInt64("rate-limit.bucket.capacity")
+			quantum      = v.GetInt64("rate-limit.bucket.quantum")
+			key          = RateLimitKey(strings.ToUpper(v.GetString("rate-limit.key")))
+
+			// the buckets fill at the request rate of the replay, if it
+			// has one, rather than at a fixed rate
+			rateReplay *replay
+		)
+		if rp != nil && rp.has("request_rate") {
+			rateReplay = rp
+		}
+
+		if fillInterval <= 0 && rateReplay == nil {
+			return nil, fmt.Errorf("--rate-limit-bucket-fill-interval must be > 0 if --rate-limit-behavior is set to not NONE")
+		}
+		if capacity <= 0 {
+			return nil, fmt.Errorf("--rate-limit-bucket-capacity must be > 0 if --rate-limit-behavior is set to not NONE")
+		}
+		if quantum <= 0 && rateReplay == nil {
+			return nil, fmt.Errorf("--rate-limit-bucket-quantum must be > 0 if --rate-limit-behavior is set to not NONE")
+		}
+		if key != RateLimitKeyGlobal && key != RateLimitKeyClient {
+			return nil, fmt.Errorf("unknown rate-limit-key value: %s", key)
+		}
+
+		var rateLimiter RateLimiter
+		switch behavior {
+		case "HARD":
+			code := v.GetInt("rate-limit.hard-status-code")
+			rateLimiter = NewRateLimiterHard(fillInterval, capacity, quantum, key, rateReplay, code)
+			parameters.RateLimitHardStatusCode = &code
+		case "QUEUE":
+			rateLimiter = NewRateLimiterQueue(fillInterval, capacity, quantum, key, rateReplay)
+		case "CLOSE":
+			rateLimiter = NewRateLimiterClose(fillInterval, capacity, quantum, key, rateReplay)
+		case "RESET":
+			rateLimiter = NewRateLimiterReset(fillInterval, capacity, quantum, key, rateReplay)
+		default:
+			return nil, fmt.Errorf("unknown rate-limit-behavior value: %s", behavior)
+		}
+
+		if rateReplay == nil {
+			parameters.RateLimitBucketFillInterval = func() *string {
+				s := fillInterval.String()
+				return &s
+			}()
+			parameters.RateLimitBucketQuauntum = &quantum
+		}
+		parameters.RateLimitBucketCapacity = &capacity
+		parameters.RateLimitKey = string(key)
+
+		profile.options = append(profile.options, WithRateLimiter(rateLimiter))
+	}
+
+	parameters.RateLimitBehavior = behavior
+
+	if expression := v.GetString("error.expression"); expression != "" {
+		middleware, err := NewErrorExpressionMiddleware(expression, rp)
+		if err != nil {
+			return nil, fmt.Errorf("error expression error: %s", err)
+		}
+
+		parameters.ErrorExpression = &expression
+
+		profile.options = append(profile.options, WithError(middleware))
+	}
+
+	response, responseParameters, err := buildResponse(v)
+	if err != nil {
+		return nil, err
+	}
+	parameters.responseParameters = responseParameters
+	profile.options = append(profile.options, WithResponse(response))
+
+	phases, phaseParameters, err := buildPhases(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, phase := range phases {
+		profile.options = append(profile.options, WithPhase(phase))
+	}
+	parameters.Phases = phaseParameters
+
+	return profile, nil
+}
+
+// durationParameter returns d as reported in the parameters file.
+func durationParameter(d time.Duration) *string {
+	s := d.String()
+	return &s
+}
+
+// buildLatency builds the latency middleware described by the latency keys of
+// v, whose expressions can refer to the variables of replay. Mixtures are only
+// allowed if mixture is true, so they cannot be nested.
+func buildLatency(v *viper.Viper, replay *replay, mixture bool) (Middleware, *latencyParameters, error) {
+	parameters := &latencyParameters{}
+
+	name := v.GetString("latency.distribution")
+	parameters.LatencyDistribution = name
+
+	var middleware latencyMiddleware
+	var distribution latencyDistribution
+	switch name {
+	case "NORMAL":
+		mean := v.GetDuration("latency.normal.mean")
+		stddev := v.GetDuration("latency.normal.stddev")
+		parameters.LatencyDistributionNormalMean = durationParameter(mean)
+		parameters.LatencyDistributionNormalStandardDeviation = durationParameter(stddev)
+		middleware = NewLatencyMiddlewareNormal(mean, stddev)
+	case "EXPRESSION":
+		mean := v.GetString("latency.expression.mean-ms")
+		parameters.LatencyDistributionExpressionMean = &mean
+
+		stddev := v.GetString("latency.expression.stddev-ms")
+		parameters.LatencyDistributionExpressionStandardDeviation = &stddev
+
+		lm, err := NewLatencyMiddlewareExpression(mean, stddev, replay)
+		if err != nil {
+			return nil, nil, fmt.Errorf("latency expression error: %s", err)
+		}
+		middleware = lm
+	case "CONSTANT":
+		value := v.GetDuration("latency.constant.value")
+		if value < 0 {
+			return nil, nil, fmt.Errorf("--latency-constant-value must be >= 0")
+		}
+		parameters.LatencyDistributionConstant = durationParameter(value)
+		distribution = &constantDistribution{value: value}
+	case "UNIFORM":
+		min := v.GetDuration("latency.uniform.min")
+		max := v.GetDuration("latency.uniform.max")
+		if min < 0 || max < min {
+			return nil, nil, fmt.Errorf("--latency-uniform-min must be >= 0 and <= --latency-uniform-max")
+		}
+		parameters.LatencyDistributionUniformMin = durationParameter(min)
+		parameters.LatencyDistributionUniformMax = durationParameter(max)
+		distribution = &uniformDistribution{min: min, max: max}
+	case "EXPONENTIAL":
+		mean := v.GetDuration("latency.exponential.mean")
+		if mean < 0 {
+			return nil, nil, fmt.Errorf("--latency-exponential-mean must be >= 0")
+		}
+		parameters.LatencyDistributionExponentialMean = durationParameter(mean)
+		distribution = &exponentialDistribution{mean: mean}
+	case "LOGNORMAL":
+		median := v.GetDuration("latency.lognormal.median")
+		sigma := v.GetFloat64("latency.lognormal.sigma")
+		if median < 0 || sigma < 0 {
+			return nil, nil, fmt.Errorf("--latency-lognormal-median and --latency-lognormal-sigma must be >= 0")
+		}
+		parameters.LatencyDistributionLognormalMedian = durationParameter(median)
+		parameters.LatencyDistributionLognormalSigma = &sigma
+		distribution = &lognormalDistribution{median: median, sigma: sigma}
+	case "PARETO":
+		scale := v.GetDuration("latency.pareto.scale")
+		shape := v.GetFloat64("latency.pareto.shape")
+		if scale < 0 || shape <= 0 {
+			return nil, nil, fmt.Errorf("--latency-pareto-scale must be >= 0 and --latency-pareto-shape > 0")
+		}
+		parameters.LatencyDistributionParetoScale = durationParameter(scale)
+		parameters.LatencyDistributionParetoShape = &shape
+		distribution = &paretoDistribution{scale: scale, shape: shape}
+	case "WEIBULL":
+		scale := v.GetDuration("latency.weibull.scale")
+		shape := v.GetFloat64("latency.weibull.shape")
+		if scale < 0 || shape <= 0 {
+			return nil, nil, fmt.Errorf("--latency-weibull-scale must be >= 0 and --latency-weibull-shape > 0")
+		}
+		parameters.LatencyDistributionWeibullScale = durationParameter(scale)
+		parameters.LatencyDistributionWeibullShape = &shape
+		distribution = &weibullDistribution{scale: scale, shape: shape}
+	case "MIXTURE":
+		if !mixture {
+			return nil, nil, fmt.Errorf("latency mixtures cannot be nested")
+		}
+
+		settings, err := getSettingsList(v, "latency.mixture")
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(settings) == 0 {
+			return nil, nil, fmt.Errorf("--latency-mixture must have at least one component")
+		}
+
+		components := []latencyDistribution{}
+		weights := []float64{}
+		for i, s := range settings {
+			cv := newProfileViper(map[string]interface{}{"latency": s})
+
+			weight := cv.GetFloat64("latency.weight")
+			if weight <= 0 {
+				return nil, nil, fmt.Errorf("latency mixture component %d: weight must be > 0", i)
+			}
+
+			component, componentParameters, err := buildLatency(cv, replay, false)
+			if err != nil {
+				return nil, nil, fmt.Errorf("latency mixture component %d: %s", i, err)
+			}
+			lm, ok := component.(*LatencyMiddlewareDistribution)
+			if !ok {
+				return nil, nil, fmt.Errorf("latency mixture component %d: %s latencies cannot be mixed", i, componentParameters.LatencyDistribution)
+			}
+
+			components = append(components, lm)
+			weights = append(weights, weight)
+			parameters.LatencyDistributionMixture = append(parameters.LatencyDistributionMixture, latencyMixtureParameters{
+				Weight:            weight,
+				latencyParameters: *componentParameters,
+			})
+		}
+		distribution = newMixtureDistribution(components, weights)
+	case "PERCENTILES":
+		percentiles := []latencyPercentile{}
+		for _, p := range []struct {
+			key       string
+			rank      float64
+			parameter **string
+		}{
+			{"p50", 0.5, &parameters.LatencyDistributionPercentilesP50},
+			{"p90", 0.9, &parameters.LatencyDistributionPercentilesP90},
+			{"p99", 0.99, &parameters.LatencyDistributionPercentilesP99},
+			{"p999", 0.999, &parameters.LatencyDistributionPercentilesP999},
+		} {
+			value := v.GetDuration("latency.percentiles." + p.key)
+			if value == 0 {
+				continue
+			}
+			if value < 0 {
+				return nil, nil, fmt.Errorf("--latency-percentiles-%s must be > 0", p.key)
+			}
+			if len(percentiles) > 0 && value < percentiles[len(percentiles)-1].value {
+				return nil, nil, fmt.Errorf("--latency-percentiles-%s must be >= the lower percentiles", p.key)
+			}
+			*p.parameter = durationParameter(value)
+			percentiles = append(percentiles, latencyPercentile{rank: p.rank, value: value})
+		}
+		if len(percentiles) < 2 {
+			return nil, nil, fmt.Errorf("at least two of --latency-percentiles-p50, -p90, -p99 and -p999 must be set")
+		}
+		distribution = newPercentileDistribution(percentiles)
+	case "EMPIRICAL":
+		path := v.GetString("latency.empirical.path")
+		if path == "" {
+			return nil, nil, fmt.Errorf("--latency-empirical-path must be set")
+		}
+		cumulative := v.GetBool("latency.empirical.cumulative")
+
+		ed, err := loadEmpiricalDistribution(path, cumulative)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		summary := ed.summary()
+		parameters.LatencyDistributionEmpiricalPath = &path
+		parameters.LatencyDistributionEmpiricalCumulative = &cumulative
+		parameters.LatencyDistributionEmpiricalCount = &summary.Count
+		parameters.LatencyDistributionEmpiricalMin = durationParameter(summary.Min)
+		parameters.LatencyDistributionEmpiricalMax = durationParameter(summary.Max)
+		parameters.LatencyDistributionEmpiricalMean = durationParameter(summary.Mean)
+		parameters.LatencyDistributionEmpiricalP50 = durationParameter(summary.P50)
+		parameters.LatencyDistributionEmpiricalP90 = durationParameter(summary.P90)
+		parameters.LatencyDistributionEmpiricalP99 = durationParameter(summary.P99)
+		parameters.LatencyDistributionEmpiricalP999 = durationParameter(summary.P999)
+		distribution = ed
+	default:
+		return nil, nil, fmt.Errorf("unknown latency-distribution value: %s", name)
+	}
+
+	if distribution != nil {
+		middleware = NewLatencyMiddlewareDistribution(distribution)
+	}
+
+	min := v.GetDuration("latency.min")
+	max := v.GetDuration("latency.max")
+	if min < 0 || max < 0 || (max > 0 && max < min) {
+		return nil, nil, fmt.Errorf("--latency-min and --latency-max must be >= 0, and --latency-max >= --latency-min unless it is 0")
+	}
+	if min > 0 {
+		parameters.LatencyMin = durationParameter(min)
+	}
+	if max > 0 {
+		parameters.LatencyMax = durationParameter(max)
+	}
+	middleware.setBounds(min, max)
+
+	return middleware, parameters, nil
+}
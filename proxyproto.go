@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a connection may take to send its PROXY
+// protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyV1MaxLength is the longest a version 1 header may be, CRLF included.
+const proxyV1MaxLength = 107
+
+// proxyListener reads the PROXY protocol header (version 1 or 2) sent by a
+// load balancer in front of the server at the start of each connection, and
+// makes the client address it carries the remote address of the connection.
+// Connections without a valid header are closed: as the protocol requires,
+// its presence is not guessed.
+type proxyListener struct {
+	net.Listener
+	connections *connections
+
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+}
+
+func newProxyListener(listener net.Listener, connections *connections) *proxyListener {
+	l := &proxyListener{
+		Listener:    listener,
+		connections: connections,
+		conns:       make(chan net.Conn),
+		done:        make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.readHeader(conn)
+	}
+}
+
+func (l *proxyListener) readHeader(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	addr, err := readProxyHeader(conn)
+	if err != nil {
+		l.connections.recordProxyFailure()
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// the header of health checks sent by the proxy itself carries no
+	// address, they keep the address of the proxy
+	if addr != nil {
+		if c, ok := conn.(*trackedConn); ok {
+			l.connections.readdress(c, addr)
+		} else {
+			conn = &proxiedConn{Conn: conn, remoteAddr: addr}
+		}
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+// proxiedConn is a connection whose remote address is given by its PROXY
+// protocol header.
+type proxiedConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// readProxyHeader reads the PROXY protocol header at the start of r, without
+// reading past it. It returns the source address it carries, or nil if it
+// carries none, such as for connections the proxy makes on its own behalf.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	prefix := make([]byte, len(proxyV1Prefix))
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, fmt.Errorf("could not read PROXY protocol header: %s", err)
+	}
+
+	switch {
+	case bytes.Equal(prefix, proxyV1Prefix):
+		return readProxyV1Header(r)
+	case bytes.Equal(prefix, proxyV2Signature[:len(prefix)]):
+		return readProxyV2Header(r)
+	default:
+		return nil, fmt.Errorf("no PROXY protocol header")
+	}
+}
+
+// readProxyV1Header reads the rest of a version 1 (text) header, after its
+// prefix, e.g. TCP4 192.0.2.1 192.0.2.2 56324 443\r\n.
+func readProxyV1Header(r io.Reader) (net.Addr, error) {
+	line := []byte{}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line)+len(proxyV1Prefix) >= proxyV1MaxLength {
+			return nil, fmt.Errorf("PROXY protocol header is too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("could not read PROXY protocol header: %s", err)
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	switch fields[0] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol family: %s", fields[0])
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid PROXY protocol header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[1])
+	if ip == nil || (fields[0] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid PROXY protocol source address: %s", fields[1])
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source port: %s", fields[3])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header reads the rest of a version 2 (binary) header, after the
+// beginning of its signature.
+func readProxyV2Header(r io.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	copy(header, proxyV2Signature)
+	if _, err := io.ReadFull(r, header[len(proxyV1Prefix):]); err != nil {
+		return nil, fmt.Errorf("could not read PROXY protocol header: %s", err)
+	}
+	if !bytes.Equal(header[:len(proxyV2Signature)], proxyV2Signature) {
+		return nil, fmt.Errorf("no PROXY protocol header")
+	}
+
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 {
+		return nil, fmt.Errorf("unknown PROXY protocol version: %d", version)
+	}
+	family := header[13]
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("could not read PROXY protocol header: %s", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol command: %d", command)
+	}
+
+	// the addresses are followed by TLVs, which are ignored
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, fmt.Errorf("PROXY protocol header is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, fmt.Errorf("PROXY protocol header is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// UDP, unix sockets and unspecified families carry no address the
+		// server can use
+		return nil, nil
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header returns a version 2 header with command and family, carrying
+// payload.
+func proxyV2Header(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// proxyV2Addresses returns the addresses of a version 2 header: source and
+// destination IPs, then source and destination ports.
+func proxyV2Addresses(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	payload := append(append([]byte{}, src...), dst...)
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+	return append(payload, ports...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := proxyV2Addresses(net.ParseIP("192.0.2.1").To4(), net.ParseIP("192.0.2.2").To4(), 56324, 443)
+	ipv6 := proxyV2Addresses(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 443)
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   string
+		err    bool
+	}{
+		{name: "v1 TCP4", header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n"), want: "192.0.2.1:56324"},
+		{name: "v1 TCP6", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), want: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 UNKNOWN with addresses", header: []byte("PROXY UNKNOWN 192.0.2.1 192.0.2.2 56324 443\r\n")},
+		{name: "v1 unknown family", header: []byte("PROXY UDP4 192.0.2.1 192.0.2.2 56324 443\r\n"), err: true},
+		{name: "v1 missing fields", header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n"), err: true},
+		{name: "v1 invalid address", header: []byte("PROXY TCP4 192.0.2.300 192.0.2.2 56324 443\r\n"), err: true},
+		{name: "v1 IPv6 address as TCP4", header: []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"), err: true},
+		{name: "v1 IPv4 address as TCP6", header: []byte("PROXY TCP6 192.0.2.1 192.0.2.2 56324 443\r\n"), err: true},
+		{name: "v1 invalid port", header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 65536 443\r\n"), err: true},
+		{name: "v1 without CRLF", header: []byte("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\n"), err: true},
+		{name: "v1 too long", header: []byte("PROXY TCP6 " + strings.Repeat("f", 100) + "\r\n"), err: true},
+		{name: "v2 TCP over IPv4", header: proxyV2Header(0x1, 0x11, ipv4), want: "192.0.2.1:56324"},
+		{name: "v2 TCP over IPv6", header: proxyV2Header(0x1, 0x21, ipv6), want: "[2001:db8::1]:56324"},
+		{name: "v2 with TLVs", header: proxyV2Header(0x1, 0x11, append(append([]byte{}, ipv4...), 0x04, 0x00, 0x02, 'h', 'i')), want: "192.0.2.1:56324"},
+		{name: "v2 LOCAL", header: proxyV2Header(0x0, 0x11, ipv4)},
+		{name: "v2 LOCAL without addresses", header: proxyV2Header(0x0, 0x00, nil)},
+		{name: "v2 UDP", header: proxyV2Header(0x1, 0x12, ipv4)},
+		{name: "v2 unknown command", header: proxyV2Header(0x2, 0x11, ipv4), err: true},
+		{name: "v2 unknown version", header: append(append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 12), ipv4...), err: true},
+		{name: "v2 short addresses", header: proxyV2Header(0x1, 0x11, ipv4[:8]), err: true},
+		{name: "v2 truncated", header: proxyV2Header(0x1, 0x21, ipv6)[:30], err: true},
+		{name: "v2 invalid signature", header: append([]byte("\r\n\r\n\x00\r\nQUIX\n"), 0x21, 0x11, 0, 12), err: true},
+		{name: "no header", header: []byte("GET / HTTP/1.1\r\n\r\n"), err: true},
+		{name: "empty", header: []byte{}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the request following the header is left to be read
+			r := bytes.NewReader(append(append([]byte{}, tt.header...), "GET / HTTP/1.1\r\n"...))
+
+			addr, err := readProxyHeader(r)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error: %v", err, tt.err)
+			}
+			if tt.err {
+				return
+			}
+
+			switch {
+			case tt.want == "" && addr != nil:
+				t.Fatalf("got address %s, want none", addr)
+			case tt.want != "" && (addr == nil || addr.String() != tt.want):
+				t.Fatalf("got address %v, want %s", addr, tt.want)
+			}
+
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Fatalf("header read past its end, left %q", rest)
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "client address", header: "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n", want: "192.0.2.1:56324"},
+		{name: "proxy health check", header: "PROXY UNKNOWN\r\n"},
+		{name: "no header", header: "GET / HTTP/1.1\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cs := newConnections(ConnectionFaults{}, ConnectionLimit{})
+			listener := newProxyListener(cs.Listener(l), cs)
+			defer listener.Close()
+
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write([]byte(tt.header + "ping")); err != nil {
+				t.Fatal(err)
+			}
+
+			accepted := make(chan net.Conn, 1)
+			go func() {
+				if conn, err := listener.Accept(); err == nil {
+					accepted <- conn
+				}
+			}()
+
+			if strings.HasPrefix(tt.header, "GET") {
+				client.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := client.Read(make([]byte, 1)); err == nil {
+					t.Fatal("connection without a header was not closed")
+				}
+				if failures := cs.Statistics().ProxyProtocolFailures; failures != 1 {
+					t.Fatalf("got %d PROXY protocol failures, want 1", failures)
+				}
+				return
+			}
+
+			var conn net.Conn
+			select {
+			case conn = <-accepted:
+				defer conn.Close()
+			case <-time.After(time.Second):
+				t.Fatal("connection was not accepted")
+			}
+
+			want := tt.want
+			if want == "" {
+				want = client.LocalAddr().String()
+			}
+			if conn.RemoteAddr().String() != want {
+				t.Fatalf("got remote address %s, want %s", conn.RemoteAddr(), want)
+			}
+			if cs.get(want) == nil {
+				t.Fatalf("connection not tracked under %s", want)
+			}
+
+			b := make([]byte, 4)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Read(b); err != nil || string(b) != "ping" {
+				t.Fatalf("got %q (%v) after the header, want ping", b, err)
+			}
+		})
+	}
+}
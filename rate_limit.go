@@ -1,8 +1,10 @@
 package main
 
 import (
-	"fmt"
+	"math"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/juju/ratelimit"
@@ -12,6 +14,27 @@ type RateLimiter interface {
 	Middleware
 }
 
+// bucketLimiter is implemented by the rate limiters taking tokens from
+// buckets.
+type bucketLimiter interface {
+	rateLimitBuckets() *rateLimitBuckets
+}
+
+// carryOverTokens starts the buckets of next with the tokens left in those of
+// previous, if both are rate limiters with buckets, so that rebuilding a rate
+// limiter does not refill it.
+func carryOverTokens(next, previous Middleware) {
+	n, ok := next.(bucketLimiter)
+	if !ok {
+		return
+	}
+	p, ok := previous.(bucketLimiter)
+	if !ok {
+		return
+	}
+	n.rateLimitBuckets().carryOver(p.rateLimitBuckets())
+}
+
 type RateLimiterNone struct{}
 
 func (rl *RateLimiterNone) WrapHTTP(next http.Handler) http.Handler {
@@ -21,74 +44,271 @@ func (rl *RateLimiterNone) WrapHTTP(next http.Handler) http.Handler {
 }
 
 type RateLimiterHard struct {
-	bucket     *ratelimit.Bucket
+	buckets    *rateLimitBuckets
 	statusCode int
 }
 
-func NewRateLimiterHard(fillInterval time.Duration, capacity, quantum int64, statusCode int) *RateLimiterHard {
+func NewRateLimiterHard(fillInterval time.Duration, capacity, quantum int64, key RateLimitKey, replay *replay, statusCode int) *RateLimiterHard {
 	return &RateLimiterHard{
-		bucket:     ratelimit.NewBucketWithQuantum(fillInterval, capacity, quantum),
+		buckets:    newRateLimitBuckets(fillInterval, capacity, quantum, key, replay),
 		statusCode: statusCode,
 	}
 }
 
+func (rl *RateLimiterHard) rateLimitBuckets() *rateLimitBuckets {
+	return rl.buckets
+}
+
 func (rl *RateLimiterHard) WrapHTTP(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		if rl.bucket.TakeAvailable(1) == 0 {
+		if rl.buckets.bucket(r).TakeAvailable(1) == 0 {
+			detailsFromRequest(r).setRateLimit(rateLimitLimited, 0)
 			http.Error(rw, http.StatusText(rl.statusCode), rl.statusCode)
 			return
 		}
+		detailsFromRequest(r).setRateLimit(rateLimitAllowed, 0)
 		next.ServeHTTP(rw, r)
 	})
 }
 
 type RateLimiterQueue struct {
-	bucket *ratelimit.Bucket
+	buckets *rateLimitBuckets
 }
 
-func NewRateLimiterQueue(fillInterval time.Duration, capacity, quantum int64) *RateLimiterQueue {
+func NewRateLimiterQueue(fillInterval time.Duration, capacity, quantum int64, key RateLimitKey, replay *replay) *RateLimiterQueue {
 	return &RateLimiterQueue{
-		bucket: ratelimit.NewBucketWithQuantum(fillInterval, capacity, quantum),
+		buckets: newRateLimitBuckets(fillInterval, capacity, quantum, key, replay),
 	}
 }
 
+func (rl *RateLimiterQueue) rateLimitBuckets() *rateLimitBuckets {
+	return rl.buckets
+}
+
 func (rl *RateLimiterQueue) WrapHTTP(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		rl.bucket.Wait(1)
+		wait := rl.buckets.bucket(r).Take(1)
+		if wait > 0 {
+			detailsFromRequest(r).setRateLimit(rateLimitQueued, wait)
+			if !sleepRequest(r, wait) {
+				return
+			}
+		} else {
+			detailsFromRequest(r).setRateLimit(rateLimitAllowed, 0)
+		}
 		next.ServeHTTP(rw, r)
 	})
 }
 
 type RateLimiterClose struct {
-	bucket *ratelimit.Bucket
+	buckets *rateLimitBuckets
 }
 
-func NewRateLimiterClose(fillInterval time.Duration, capacity, quantum int64) *RateLimiterClose {
+func NewRateLimiterClose(fillInterval time.Duration, capacity, quantum int64, key RateLimitKey, replay *replay) *RateLimiterClose {
 	return &RateLimiterClose{
-		bucket: ratelimit.NewBucketWithQuantum(fillInterval, capacity, quantum),
+		buckets: newRateLimitBuckets(fillInterval, capacity, quantum, key, replay),
 	}
 }
 
+func (rl *RateLimiterClose) rateLimitBuckets() *rateLimitBuckets {
+	return rl.buckets
+}
+
 func (rl *RateLimiterClose) WrapHTTP(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		if rl.bucket.TakeAvailable(1) == 0 {
-			hj, ok := rw.(http.Hijacker)
-			if !ok {
-				panic("connection not hijackable") // should never happen
-			}
-			conn, _, err := hj.Hijack()
-			if err != nil {
-				http.Error(rw, fmt.Sprintf("could not hijack connection: %s", err.Error()), http.StatusInternalServerError)
-				return
-			}
-			conn.Close() // drop connection
+		if rl.buckets.bucket(r).TakeAvailable(1) == 0 {
+			detailsFromRequest(r).setRateLimit(rateLimitLimited, 0)
+			closeConnection(rw, r)
 			return
 		}
 
+		detailsFromRequest(r).setRateLimit(rateLimitAllowed, 0)
 		next.ServeHTTP(rw, r)
 	})
 }
 
+type RateLimiterReset struct {
+	buckets *rateLimitBuckets
+}
+
+func NewRateLimiterReset(fillInterval time.Duration, capacity, quantum int64, key RateLimitKey, replay *replay) *RateLimiterReset {
+	return &RateLimiterReset{
+		buckets: newRateLimitBuckets(fillInterval, capacity, quantum, key, replay),
+	}
+}
+
+func (rl *RateLimiterReset) rateLimitBuckets() *rateLimitBuckets {
+	return rl.buckets
+}
+
+func (rl *RateLimiterReset) WrapHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if rl.buckets.bucket(r).TakeAvailable(1) == 0 {
+			detailsFromRequest(r).setRateLimit(rateLimitLimited, 0)
+			resetStream(rw, r)
+			return
+		}
+
+		detailsFromRequest(r).setRateLimit(rateLimitAllowed, 0)
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// decisions of the rate limiter on a request, as recorded in its details
+const (
+	rateLimitAllowed = "allowed"
+	rateLimitLimited = "limited"
+	rateLimitQueued  = "queued"
+)
+
+type RateLimitKey string
+
+const (
+	// limits all requests together
+	RateLimitKeyGlobal RateLimitKey = "GLOBAL"
+
+	// limits the requests of each client address separately
+	RateLimitKeyClient RateLimitKey = "CLIENT"
+)
+
+// rateLimitBuckets holds the token buckets of a rate limiter: a single one,
+// or one per client address. If it follows the request rate of a replay, its
+// buckets are replaced as the rate changes, keeping their tokens.
+type rateLimitBuckets struct {
+	fillInterval      time.Duration
+	capacity, quantum int64
+	key               RateLimitKey
+	replay            *replay
+
+	global *ratelimit.Bucket
+
+	mu      sync.Mutex
+	clients map[string]*ratelimit.Bucket
+
+	// the request rate of the replay the buckets fill at
+	rate float64
+}
+
+func newRateLimitBuckets(fillInterval time.Duration, capacity, quantum int64, key RateLimitKey, replay *replay) *rateLimitBuckets {
+	b := &rateLimitBuckets{
+		fillInterval: fillInterval,
+		capacity:     capacity,
+		quantum:      quantum,
+		key:          key,
+		replay:       replay,
+		clients:      map[string]*ratelimit.Bucket{},
+	}
+	if replay != nil {
+		b.rate, _ = replay.value("request_rate", 0)
+	}
+	if key != RateLimitKeyClient {
+		b.global = b.newBucket()
+	}
+	return b
+}
+
+// minReplayRate is the lowest request rate of a replay buckets fill at; below
+// it, they are not filled at all.
+const minReplayRate = 0.001
+
+func (b *rateLimitBuckets) newBucket() *ratelimit.Bucket {
+	switch {
+	case b.replay == nil:
+		return ratelimit.NewBucketWithQuantum(b.fillInterval, b.capacity, b.quantum)
+	case b.rate < minReplayRate:
+		return ratelimit.NewBucketWithQuantum(maxDuration, b.capacity, 1)
+	default:
+		return ratelimit.NewBucketWithRate(b.rate, b.capacity)
+	}
+}
+
+// startAt makes the buckets follow the replay, if any, from start.
+func (b *rateLimitBuckets) startAt(start time.Time) {
+	if b.replay != nil {
+		b.replay.start = start
+	}
+}
+
+// carryOver starts the buckets with the tokens left in those of previous,
+// including those owed to queued requests, if both limit requests by the same
+// key.
+func (b *rateLimitBuckets) carryOver(previous *rateLimitBuckets) {
+	if b == previous {
+		return
+	}
+
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	take := func(bucket, old *ratelimit.Bucket) {
+		bucket.Take(bucket.Capacity() - old.Available())
+	}
+	switch {
+	case b.global != nil && previous.global != nil:
+		take(b.global, previous.global)
+	case b.global == nil && previous.global == nil:
+		for client, old := range previous.clients {
+			bucket := b.newBucket()
+			take(bucket, old)
+			b.clients[client] = bucket
+		}
+	}
+}
+
+// bucket returns the bucket r takes its token from.
+func (b *rateLimitBuckets) bucket(r *http.Request) *ratelimit.Bucket {
+	if b.global != nil && b.replay == nil {
+		return b.global
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.replay != nil {
+		b.follow()
+	}
+	if b.global != nil {
+		return b.global
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+
+	bucket, ok := b.clients[client]
+	if !ok {
+		bucket = b.newBucket()
+		b.clients[client] = bucket
+	}
+	return bucket
+}
+
+// follow replaces the buckets once the request rate of the replay is more
+// than 1% off the rate they fill at. The new buckets start with the tokens of
+// the old ones, including those owed to queued requests.
+func (b *rateLimitBuckets) follow() {
+	rate, _ := b.replay.value("request_rate", b.replay.elapsed())
+	if math.Abs(rate-b.rate) <= 0.01*b.rate && (rate < minReplayRate) == (b.rate < minReplayRate) {
+		return
+	}
+	b.rate = rate
+
+	replace := func(old *ratelimit.Bucket) *ratelimit.Bucket {
+		bucket := b.newBucket()
+		bucket.Take(bucket.Capacity() - old.Available())
+		return bucket
+	}
+	if b.global != nil {
+		b.global = replace(b.global)
+	}
+	for client, bucket := range b.clients {
+		b.clients[client] = replace(bucket)
+	}
+}
+
 type RateLimitBehavior string
 
 const (
@@ -98,9 +318,15 @@ const (
 	// returns a 429 when rate is exceeded
 	RateLimitBehaviorHard RateLimitBehavior = "HARD"
 
-	// closes the connection if the rate is exceeded
+	// closes the connection if the rate is exceeded; over HTTP/2 the
+	// connection is shut down with a GOAWAY, sent along with the headers of a
+	// 503, and the stream of the request is reset
 	RateLimitBehaviorClose RateLimitBehavior = "CLOSE"
 
+	// resets the stream (HTTP/2) or closes the connection (HTTP/1.x) of the
+	// request if the rate is exceeded
+	RateLimitBehaviorReset RateLimitBehavior = "RESET"
+
 	// queues request until there is available capacity
 	RateLimitBehaviorQueue RateLimitBehavior = "QUEUE"
 )
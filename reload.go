@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// reloadDebounce is how long to wait for further changes to the config file
+// before reloading it. Editors often write a file in several steps.
+const reloadDebounce = 100 * time.Millisecond
+
+// Reload rebuilds the behavior of every route from opts, as given to
+// NewServer, and swaps it in without interrupting requests in flight or
+// resetting statistics. The routes and their phase timelines must be the same
+// as the ones the server was created with; if they are not, or if opts are
+// otherwise invalid, the current behavior is kept.
+func (s *Server) Reload(opts ...func(*ServerOptions)) error {
+	swap, err := s.prepareReload(opts...)
+	if err != nil {
+		return err
+	}
+	swap()
+	return nil
+}
+
+// prepareReload rebuilds the behavior of every route from opts, as Reload
+// does, and returns a function swapping it in. Several servers can thus be
+// reloaded together, only if all of them can be.
+func (s *Server) prepareReload(opts ...func(*ServerOptions)) (func(), error) {
+	reloaded := routes(opts)
+	if len(reloaded) != len(s.routes) {
+		return nil, fmt.Errorf("routes cannot be added or removed by a reload")
+	}
+
+	type pipelines struct {
+		base        http.Handler
+		rateLimiter Middleware
+		settings    map[string]interface{}
+		phases      []*mountedPhase
+	}
+
+	built := make([]pipelines, len(reloaded))
+	for i, r := range reloaded {
+		route := s.route(r.Path)
+		if route == nil || strings.Join(route.methods, ",") != strings.Join(r.Methods, ",") {
+			return nil, fmt.Errorf("routes cannot be added or removed by a reload: %s", r.Path)
+		}
+
+		serverOptions := resolveOptions(r.Options)
+		if len(serverOptions.Phases) != len(route.phases) {
+			return nil, fmt.Errorf("route %s: phases cannot be added or removed by a reload", r.Path)
+		}
+
+		built[i].base = s.buildPipeline(serverOptions)
+		built[i].rateLimiter = serverOptions.RateLimiter
+		built[i].settings = serverOptions.Settings
+		for j, phase := range serverOptions.Phases {
+			if phase.Start != route.phases[j].Start || phase.Duration != route.phases[j].Duration {
+				return nil, fmt.Errorf("route %s: phase timelines cannot be changed by a reload", r.Path)
+			}
+			phaseOptions := resolveOptions(phase.Options)
+			built[i].phases = append(built[i].phases, &mountedPhase{
+				handler:     s.buildPipeline(phaseOptions),
+				rateLimiter: phaseOptions.RateLimiter,
+			})
+		}
+	}
+
+	return func() {
+		for i, r := range reloaded {
+			s.route(r.Path).reload(built[i].base, built[i].rateLimiter, built[i].settings, built[i].phases)
+		}
+		s.recordEvent(&Event{Time: time.Now().UTC(), Type: EventReload})
+	}, nil
+}
+
+// reload replaces the base and phase pipelines of the route and serves
+// requests using the one currently active. The rate limiters of the new
+// pipelines start with the tokens left in those they replace.
+func (route *mountedRoute) reload(base http.Handler, rateLimiter Middleware, settings map[string]interface{}, phases []*mountedPhase) {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+
+	carryOverTokens(rateLimiter, route.rateLimiter)
+	route.base = base
+	route.rateLimiter = rateLimiter
+	route.settings = settings
+	for i, phase := range phases {
+		carryOverTokens(phase.rateLimiter, route.phases[i].rateLimiter)
+		route.phases[i].handler = phase.handler
+		route.phases[i].rateLimiter = phase.rateLimiter
+	}
+
+	if route.active != nil {
+		route.pipeline.Store(route.active.handler)
+	} else {
+		route.pipeline.Store(route.base)
+	}
+}
+
+// watchConfig calls reload each time the config file used by v changes, once
+// it has been read again, until quit is closed. Changes that cannot be read are
+// logged and otherwise ignored.
+func watchConfig(v *viper.Viper, quit <-chan struct{}, reload func() error) error {
+	path := v.ConfigFileUsed()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not watch config file: %s", err)
+	}
+
+	// watch the directory rather than the file to pick up editors replacing
+	// the file on save
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("could not watch config file: %s", err)
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		debounce := time.NewTimer(reloadDebounce)
+		debounce.Stop()
+
+		for {
+			select {
+			case event := <-watcher.Events:
+				if filepath.Clean(event.Name) == filepath.Clean(path) && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					debounce.Reset(reloadDebounce)
+				}
+			case err := <-watcher.Errors:
+				log.Printf("config file watcher error: %s", err)
+			case <-debounce.C:
+				if err := v.ReadInConfig(); err != nil {
+					log.Printf("could not reload config file, keeping current config: %s", err)
+					continue
+				}
+				if err := reload(); err != nil {
+					log.Printf("could not reload config file, keeping current config: %s", err)
+					continue
+				}
+				log.Printf("Reloaded config file %s", path)
+			case <-quit:
+				debounce.Stop()
+				return
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type ReplayEnd string
+
+const (
+	// starts the replay over from its first row
+	ReplayEndLoop ReplayEnd = "LOOP"
+
+	// keeps the values of the last row
+	ReplayEndStop ReplayEnd = "STOP"
+)
+
+// columns of a replay, and the expression variables giving their value
+var replayColumns = map[string]string{
+	"latency":        "replay_latency_ms",
+	"latency_stddev": "replay_latency_stddev_ms",
+	"error_rate":     "replay_error_rate",
+	"request_rate":   "replay_request_rate",
+}
+
+// replay is a recorded time series of the behavior of a server, such as
+// during an incident, replayed from when it is built. Its values are
+// interpolated linearly between rows.
+type replay struct {
+	start time.Time
+	end   ReplayEnd
+
+	// offsets of the rows, increasing
+	offsets []time.Duration
+
+	// values of the rows by column; latencies are in ms
+	columns map[string][]float64
+}
+
+type replayParameters struct {
+	Path     string   `json:"path"`
+	End      string   `json:"end"`
+	Rows     int      `json:"rows"`
+	Duration string   `json:"duration"`
+	Columns  []string `json:"columns"`
+}
+
+// buildReplay builds the replay described by the replay keys of v, or returns
+// nil if there is none.
+func buildReplay(v *viper.Viper) (*replay, *replayParameters, error) {
+	path := v.GetString("replay.path")
+	if path == "" {
+		return nil, nil, nil
+	}
+
+	end := ReplayEnd(strings.ToUpper(v.GetString("replay.end")))
+	switch end {
+	case ReplayEndLoop, ReplayEndStop:
+	default:
+		return nil, nil, fmt.Errorf("unknown replay-end value: %s", end)
+	}
+
+	rp, err := loadReplay(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	rp.end = end
+
+	parameters := &replayParameters{
+		Path:     path,
+		End:      string(end),
+		Rows:     len(rp.offsets),
+		Duration: rp.offsets[len(rp.offsets)-1].String(),
+		Columns:  []string{},
+	}
+	for column := range rp.columns {
+		parameters.Columns = append(parameters.Columns, column)
+	}
+	sort.Strings(parameters.Columns)
+
+	return rp, parameters, nil
+}
+
+// loadReplay reads the rows of path, a CSV file with a header naming its
+// columns or a JSON list of objects, as told by its extension. Each row has an
+// offset, in seconds or as a duration, and any of the columns of
+// replayColumns: latencies in ms or as durations, an error rate between 0 and
+// 1 and a request rate in requests per second.
+func loadReplay(path string) (*replay, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read replay: %s", err)
+	}
+
+	var rows []map[string]string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		rows, err = parseReplayCSV(b)
+	case ".json":
+		rows, err = parseReplayJSON(b)
+	default:
+		return nil, fmt.Errorf("replay must be a .csv or .json file, got: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse replay: %s", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("replay has no rows")
+	}
+
+	rp := &replay{
+		start:   time.Now(),
+		columns: map[string][]float64{},
+	}
+	for column := range rows[0] {
+		if _, ok := replayColumns[column]; ok {
+			rp.columns[column] = []float64{}
+		} else if column != "offset" {
+			return nil, fmt.Errorf("unknown replay column: %s", column)
+		}
+	}
+
+	for i, row := range rows {
+		offset, err := parseReplayOffset(row["offset"])
+		if err != nil {
+			return nil, fmt.Errorf("replay row %d: %s", i+1, err)
+		}
+		if offset < 0 || (i > 0 && offset <= rp.offsets[i-1]) {
+			return nil, fmt.Errorf("replay row %d: offsets must be >= 0 and increasing", i+1)
+		}
+		rp.offsets = append(rp.offsets, offset)
+
+		for column := range rp.columns {
+			value, ok := row[column]
+			if !ok {
+				return nil, fmt.Errorf("replay row %d: missing %s", i+1, column)
+			}
+
+			var x float64
+			switch column {
+			case "latency", "latency_stddev":
+				var d time.Duration
+				d, err = parseLatency(value)
+				x = durationMs(d)
+			default:
+				x, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			}
+			if err != nil || x < 0 || (column == "error_rate" && x > 1) {
+				return nil, fmt.Errorf("replay row %d: invalid %s: %s", i+1, column, value)
+			}
+			rp.columns[column] = append(rp.columns[column], x)
+		}
+	}
+
+	return rp, nil
+}
+
+func parseReplayCSV(b []byte) ([]map[string]string, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	header := records[0]
+	rows := []map[string]string{}
+	for _, record := range records[1:] {
+		row := map[string]string{}
+		for i, column := range header {
+			row[strings.TrimSpace(column)] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseReplayJSON(b []byte) ([]map[string]string, error) {
+	items := []map[string]interface{}{}
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, err
+	}
+
+	rows := []map[string]string{}
+	for _, item := range items {
+		row := map[string]string{}
+		for column, value := range item {
+			row[column] = fmt.Sprint(value)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseReplayOffset parses a number of seconds or a duration.
+func parseReplayOffset(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset: %s", s)
+	}
+	return d, nil
+}
+
+// has returns whether rp has column.
+func (rp *replay) has(column string) bool {
+	_, ok := rp.columns[column]
+	return ok
+}
+
+// value returns the value of column t after the start of the replay.
+func (rp *replay) value(column string, t time.Duration) (float64, error) {
+	values, ok := rp.columns[column]
+	if !ok {
+		return 0, fmt.Errorf("replay has no %s column", column)
+	}
+
+	last := len(rp.offsets) - 1
+	if period := rp.offsets[last]; rp.end == ReplayEndLoop && period > 0 {
+		t %= period
+	}
+
+	// the first row with an offset after t; before the first row and after
+	// the last one, their values apply
+	i := sort.Search(len(rp.offsets), func(i int) bool {
+		return rp.offsets[i] > t
+	})
+	switch i {
+	case 0:
+		return values[0], nil
+	case len(rp.offsets):
+		return values[last], nil
+	}
+
+	fraction := float64(t-rp.offsets[i-1]) / float64(rp.offsets[i]-rp.offsets[i-1])
+	return values[i-1] + (values[i]-values[i-1])*fraction, nil
+}
+
+// variable returns the value of the expression variable name t after the
+// start of the replay.
+func (rp *replay) variable(name string, t time.Duration) (float64, error) {
+	for column, variable := range replayColumns {
+		if variable == name {
+			if rp == nil {
+				return 0, fmt.Errorf("%s requires a replay", name)
+			}
+			return rp.value(column, t)
+		}
+	}
+	return 0, fmt.Errorf("unknown variable name: %s", name)
+}
+
+// elapsed returns how long ago the replay started.
+func (rp *replay) elapsed() time.Duration {
+	return time.Since(rp.start)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseReplayOffset(t *testing.T) {
+	tests := []struct {
+		s    string
+		want time.Duration
+		err  bool
+	}{
+		{s: "90", want: 90 * time.Second},
+		{s: "1.5", want: 1500 * time.Millisecond},
+		{s: " 0 ", want: 0},
+		{s: "1m30s", want: 90 * time.Second},
+		{s: "250ms", want: 250 * time.Millisecond},
+		{s: "later", err: true},
+		{s: "", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseReplayOffset(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("parseReplayOffset(%q): got error %v, want error: %v", tt.s, err, tt.err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseReplayOffset(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestLoadReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	type value struct {
+		column string
+		t      time.Duration
+		want   float64
+	}
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+
+		// values of the replay, looping; nil if loading fails
+		values []value
+	}{
+		{
+			name:    "CSV",
+			file:    "incident.csv",
+			content: "offset,latency,error_rate,request_rate\n0,20ms,0,500\n60,20ms,0,500\n90,2s,0.2,50\n",
+			values: []value{
+				{column: "latency", t: 30 * time.Second, want: 20},
+				{column: "latency", t: 75 * time.Second, want: 1010},
+				{column: "error_rate", t: 75 * time.Second, want: 0.1},
+				{column: "request_rate", t: 75 * time.Second, want: 275},
+			},
+		},
+		{
+			name:    "CSV with comments and durations",
+			file:    "incident.CSV",
+			content: "# recorded during the incident\noffset, latency_stddev\n0s, 10\n1m, 30ms\n",
+			values: []value{
+				{column: "latency_stddev", t: 30 * time.Second, want: 20},
+			},
+		},
+		{
+			name:    "JSON",
+			file:    "incident.json",
+			content: `[{"offset": 0, "latency": 20, "request_rate": 500}, {"offset": "1m", "latency": "220ms", "request_rate": 100}]`,
+			values: []value{
+				{column: "latency", t: 15 * time.Second, want: 70},
+				{column: "request_rate", t: 45 * time.Second, want: 200},
+			},
+		},
+		{name: "unknown extension", file: "incident.txt", content: "offset,latency\n0,20\n"},
+		{name: "CSV header only", file: "incident.csv", content: "offset,latency\n"},
+		{name: "empty CSV", file: "incident.csv", content: ""},
+		{name: "JSON empty list", file: "incident.json", content: `[]`},
+		{name: "JSON not a list", file: "incident.json", content: `{"offset": 0}`},
+		{name: "unknown column", file: "incident.csv", content: "offset,throughput\n0,20\n"},
+		{name: "missing offset", file: "incident.json", content: `[{"latency": 20}]`},
+		{name: "invalid offset", file: "incident.csv", content: "offset,latency\nsoon,20\n"},
+		{name: "negative offset", file: "incident.csv", content: "offset,latency\n-1,20\n"},
+		{name: "decreasing offsets", file: "incident.csv", content: "offset,latency\n10,20\n5,20\n"},
+		{name: "repeated offset", file: "incident.csv", content: "offset,latency\n10,20\n10,30\n"},
+		{name: "missing value", file: "incident.json", content: `[{"offset": 0, "latency": 20}, {"offset": 1}]`},
+		{name: "invalid latency", file: "incident.csv", content: "offset,latency\n0,fast\n"},
+		{name: "negative request rate", file: "incident.csv", content: "offset,request_rate\n0,-1\n"},
+		{name: "error rate above 1", file: "incident.csv", content: "offset,error_rate\n0,1.5\n"},
+		{name: "short row", file: "incident.csv", content: "offset,latency\n0\n"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, fmt.Sprintf("%d-%s", i, tt.file))
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			rp, err := loadReplay(path)
+			if (err != nil) != (tt.values == nil) {
+				t.Fatalf("got error %v, want error: %v", err, tt.values == nil)
+			}
+			if err != nil {
+				return
+			}
+
+			rp.end = ReplayEndLoop
+			for _, v := range tt.values {
+				got, err := rp.value(v.column, v.t)
+				if err != nil {
+					t.Fatalf("%s at %s: %s", v.column, v.t, err)
+				}
+				if !nearFloat(got, v.want) {
+					t.Errorf("got %s of %g at %s, want %g", v.column, got, v.t, v.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReplayValue(t *testing.T) {
+	// a latency of 10ms at 10s, 30ms at 20s and 0 at 40s
+	newReplay := func(end ReplayEnd) *replay {
+		return &replay{
+			end:     end,
+			offsets: []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second},
+			columns: map[string][]float64{"latency": {10, 30, 0}},
+		}
+	}
+
+	tests := []struct {
+		name string
+		end  ReplayEnd
+		t    time.Duration
+		want float64
+	}{
+		{name: "before the first row", end: ReplayEndStop, t: 5 * time.Second, want: 10},
+		{name: "at the first row", end: ReplayEndStop, t: 10 * time.Second, want: 10},
+		{name: "between rows", end: ReplayEndStop, t: 15 * time.Second, want: 20},
+		{name: "at a row", end: ReplayEndStop, t: 20 * time.Second, want: 30},
+		{name: "decreasing between rows", end: ReplayEndStop, t: 35 * time.Second, want: 7.5},
+		{name: "at the last row", end: ReplayEndStop, t: 40 * time.Second, want: 0},
+		{name: "stopped after the last row", end: ReplayEndStop, t: time.Hour, want: 0},
+		{name: "looping within the first period", end: ReplayEndLoop, t: 15 * time.Second, want: 20},
+		{name: "looping at the end of the first period", end: ReplayEndLoop, t: 40 * time.Second, want: 10},
+		{name: "looping in a later period", end: ReplayEndLoop, t: 2*40*time.Second + 35*time.Second, want: 7.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newReplay(tt.end).value("latency", tt.t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !nearFloat(got, tt.want) {
+				t.Fatalf("got %g, want %g", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := newReplay(ReplayEndLoop).value("error_rate", 0); err == nil {
+		t.Fatal("got a value for a missing column")
+	}
+}
+
+func TestReplaySingleRow(t *testing.T) {
+	rp := &replay{
+		end:     ReplayEndLoop,
+		offsets: []time.Duration{0},
+		columns: map[string][]float64{"request_rate": {100}},
+	}
+	for _, d := range []time.Duration{0, time.Second, time.Hour} {
+		if got, err := rp.value("request_rate", d); err != nil || got != 100 {
+			t.Fatalf("got %g (%v) at %s, want 100", got, err, d)
+		}
+	}
+}
+
+func TestReplayVariable(t *testing.T) {
+	rp := &replay{
+		end:     ReplayEndStop,
+		offsets: []time.Duration{0, 10 * time.Second},
+		columns: map[string][]float64{"error_rate": {0, 0.5}},
+	}
+
+	tests := []struct {
+		name   string
+		replay *replay
+		want   float64
+		err    bool
+	}{
+		{name: "replay_error_rate", replay: rp, want: 0.25},
+		{name: "replay_latency_ms", replay: rp, err: true},
+		{name: "replay_error_rate", replay: nil, err: true},
+		{name: "error_rate", replay: rp, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.replay.variable(tt.name, 5*time.Second)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: got error %v, want error: %v", tt.name, err, tt.err)
+			continue
+		}
+		if !nearFloat(got, tt.want) {
+			t.Errorf("%s: got %g, want %g", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "incident.csv")
+	if err := ioutil.WriteFile(path, []byte("offset,latency,error_rate\n0,20,0\n90,2000,0.2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		end  string
+		want *replayParameters
+		err  bool
+	}{
+		{name: "no replay", end: "LOOP"},
+		{name: "loop", path: path, end: "LOOP", want: &replayParameters{Path: path, End: "LOOP", Rows: 2, Duration: "1m30s", Columns: []string{"error_rate", "latency"}}},
+		{name: "lowercase stop", path: path, end: "stop", want: &replayParameters{Path: path, End: "STOP", Rows: 2, Duration: "1m30s", Columns: []string{"error_rate", "latency"}}},
+		{name: "unknown end", path: path, end: "REWIND", err: true},
+		{name: "missing file", path: filepath.Join(dir, "missing.csv"), end: "LOOP", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			v.Set("replay.path", tt.path)
+			v.Set("replay.end", tt.end)
+
+			rp, parameters, err := buildReplay(v)
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want error: %v", err, tt.err)
+			}
+			if tt.want == nil {
+				if rp != nil || parameters != nil {
+					t.Fatalf("got replay %+v, want none", parameters)
+				}
+				return
+			}
+			if fmt.Sprint(*parameters) != fmt.Sprint(*tt.want) {
+				t.Fatalf("got parameters %+v, want %+v", *parameters, *tt.want)
+			}
+			if string(rp.end) != tt.want.End {
+				t.Fatalf("got end %s, want %s", rp.end, tt.want.End)
+			}
+		})
+	}
+}
+
+// nearFloat returns whether got and want are equal but for rounding.
+func nearFloat(got, want float64) bool {
+	return got-want < 1e-9 && want-got < 1e-9
+}
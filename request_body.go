@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/juju/ratelimit"
+	"github.com/spf13/viper"
+)
+
+// RequestBody describes how a server reads request bodies, to behave like a
+// saturated receiver: throttled, clients stall writing them as the TCP
+// window fills.
+type RequestBody struct {
+	// bytes read per second, or 0 to read bodies as fast as they come
+	Rate int64
+
+	// whether Rate is shared by all requests of the server rather than
+	// applying to each of them
+	Shared bool
+
+	// reading stops for Pause once PauseAfter bytes of a body have been read
+	PauseAfter int64
+	Pause      time.Duration
+}
+
+type requestBodyParameters struct {
+	Rate       *int64  `json:"rate,omitempty"`
+	Shared     bool    `json:"shared,omitempty"`
+	PauseAfter *int64  `json:"pause_after,omitempty"`
+	Pause      *string `json:"pause,omitempty"`
+}
+
+// buildRequestBody builds how the server described by v reads request bodies,
+// or returns nil if it reads them as they come.
+func buildRequestBody(v *viper.Viper) (*RequestBody, *requestBodyParameters, error) {
+	requestBody := &RequestBody{
+		Rate:       v.GetInt64("request-body.rate"),
+		Shared:     v.GetBool("request-body.shared"),
+		PauseAfter: v.GetInt64("request-body.pause-after"),
+		Pause:      v.GetDuration("request-body.pause"),
+	}
+
+	if requestBody.Rate < 0 {
+		return nil, nil, fmt.Errorf("--request-body-rate must be >= 0, got: %d", requestBody.Rate)
+	}
+	if requestBody.PauseAfter < 0 {
+		return nil, nil, fmt.Errorf("--request-body-pause-after must be >= 0, got: %d", requestBody.PauseAfter)
+	}
+	if requestBody.Pause < 0 {
+		return nil, nil, fmt.Errorf("--request-body-pause must be >= 0, got: %s", requestBody.Pause)
+	}
+	if requestBody.Rate == 0 && requestBody.Pause == 0 {
+		return nil, nil, nil
+	}
+
+	parameters := &requestBodyParameters{}
+	if requestBody.Rate > 0 {
+		parameters.Rate = &requestBody.Rate
+		parameters.Shared = requestBody.Shared
+	}
+	if requestBody.Pause > 0 {
+		parameters.PauseAfter = &requestBody.PauseAfter
+		parameters.Pause = durationParameter(requestBody.Pause)
+	}
+
+	return requestBody, parameters, nil
+}
+
+// requestBodyThrottle throttles the reading of request bodies.
+type requestBodyThrottle struct {
+	options RequestBody
+
+	// the bucket of the whole server, if its rate is shared
+	shared *ratelimit.Bucket
+}
+
+func newRequestBodyThrottle(options RequestBody) *requestBodyThrottle {
+	t := &requestBodyThrottle{
+		options: options,
+	}
+	if options.Rate > 0 && options.Shared {
+		t.shared = t.newBucket()
+	}
+	return t
+}
+
+// chunkSize is the most read from a body at once, a tenth of a second worth
+// at the rate, so that reading is smooth rather than bursty.
+func (t *requestBodyThrottle) chunkSize() int64 {
+	chunk := t.options.Rate / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	return chunk
+}
+
+func (t *requestBodyThrottle) newBucket() *ratelimit.Bucket {
+	return ratelimit.NewBucketWithRate(float64(t.options.Rate), t.chunkSize())
+}
+
+func (t *requestBodyThrottle) WrapHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if t.options.Rate == 0 && t.options.Pause == 0 {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		body := &throttledBody{
+			ReadCloser: r.Body,
+			throttle:   t,
+			request:    r,
+		}
+		if t.options.Rate > 0 {
+			body.bucket = t.shared
+			if body.bucket == nil {
+				body.bucket = t.newBucket()
+			}
+		}
+		r.Body = body
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// throttledBody is a request body read at the rate of its bucket, if it has
+// one, and paused partway through. Reading fails once the client of its
+// request goes away.
+type throttledBody struct {
+	io.ReadCloser
+	throttle *requestBodyThrottle
+	bucket   *ratelimit.Bucket
+	request  *http.Request
+
+	read   int64
+	paused bool
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	options := b.throttle.options
+
+	if options.Pause > 0 && !b.paused {
+		// stop reading at the pause rather than past it
+		if left := options.PauseAfter - b.read; left <= 0 {
+			b.paused = true
+			if !sleepRequest(b.request, options.Pause) {
+				return 0, b.request.Context().Err()
+			}
+		} else if int64(len(p)) > left {
+			p = p[:left]
+		}
+	}
+
+	if b.bucket != nil {
+		if chunk := b.throttle.chunkSize(); int64(len(p)) > chunk {
+			p = p[:chunk]
+		}
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.bucket != nil && n > 0 {
+		if !sleepRequest(b.request, b.bucket.Take(int64(n))) {
+			return n, b.request.Context().Err()
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Response describes the responses of a route once its latency, error and
+// rate limit middlewares let a request through. Without a body, they are an
+// empty 204.
+type Response struct {
+	// size of the body, in bytes
+	BodySize int64
+
+	// delay before the status and headers are sent
+	TTFB time.Duration
+
+	// bytes of the body sent per second, or 0 to send it at once
+	Rate int64
+
+	// how often the body is flushed to the client while it is trickled
+	FlushInterval time.Duration
+}
+
+type responseParameters struct {
+	ResponseBodySize      *int64  `json:"response_body_size,omitempty"`
+	ResponseTTFB          *string `json:"response_ttfb,omitempty"`
+	ResponseRate          *int64  `json:"response_rate,omitempty"`
+	ResponseFlushInterval *string `json:"response_flush_interval,omitempty"`
+}
+
+// buildResponse builds the responses described by the response keys of v.
+func buildResponse(v *viper.Viper) (Response, responseParameters, error) {
+	response := Response{
+		BodySize:      v.GetInt64("response.body-size"),
+		TTFB:          v.GetDuration("response.ttfb"),
+		Rate:          v.GetInt64("response.rate"),
+		FlushInterval: v.GetDuration("response.flush-interval"),
+	}
+	parameters := responseParameters{}
+
+	if response.BodySize < 0 {
+		return response, parameters, fmt.Errorf("--response-body-size must be >= 0")
+	}
+	if response.TTFB < 0 {
+		return response, parameters, fmt.Errorf("--response-ttfb must be >= 0")
+	}
+	if response.Rate < 0 {
+		return response, parameters, fmt.Errorf("--response-rate must be >= 0")
+	}
+	if response.Rate > 0 && response.FlushInterval <= 0 {
+		return response, parameters, fmt.Errorf("--response-flush-interval must be > 0 if --response-rate is set")
+	}
+
+	if response.TTFB > 0 {
+		parameters.ResponseTTFB = durationParameter(response.TTFB)
+	}
+	if response.BodySize > 0 {
+		parameters.ResponseBodySize = &response.BodySize
+		if response.Rate > 0 {
+			parameters.ResponseRate = &response.Rate
+			parameters.ResponseFlushInterval = durationParameter(response.FlushInterval)
+		}
+	}
+
+	return response, parameters, nil
+}
+
+func WithResponse(response Response) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.Response = response
+	}
+}
+
+// responseChunkSize is how much of the body is written at once when it is not
+// trickled.
+const responseChunkSize = 32 * 1024
+
+// responseFiller is what bodies are made of.
+var responseFiller = bytes.Repeat([]byte("abcdefghijklmnopqrstuvwxyz0123456789\n"), responseChunkSize/37+1)[:responseChunkSize]
+
+// responder writes the responses described by its options. Bodies are sent
+// without a Content-Length, chunked over HTTP/1.1, and flushed as they are
+// written.
+type responder struct {
+	options Response
+}
+
+func newResponder(options Response) *responder {
+	return &responder{
+		options: options,
+	}
+}
+
+func (rs *responder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if !sleepRequest(r, rs.options.TTFB) {
+		return
+	}
+
+	if rs.options.BodySize == 0 {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(http.StatusOK)
+	flusher, _ := rw.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	// while trickling, each chunk is what is sent per flush interval, and is
+	// sent once the previous chunks are due at the rate
+	chunkSize := int64(responseChunkSize)
+	if rs.options.Rate > 0 {
+		chunkSize = rs.options.Rate * int64(rs.options.FlushInterval) / int64(time.Second)
+		if chunkSize < 1 {
+			chunkSize = 1
+		}
+	}
+
+	start := time.Now()
+	var written int64
+	for written < rs.options.BodySize {
+		if rs.options.Rate > 0 && written > 0 {
+			due := start.Add(time.Duration(float64(written) / float64(rs.options.Rate) * float64(time.Second)))
+			if !sleepRequest(r, time.Until(due)) {
+				return
+			}
+		}
+
+		n := rs.options.BodySize - written
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if err := writeFiller(rw, n); err != nil {
+			// the client went away
+			checkAborted(r)
+			return
+		}
+		flush()
+		written += n
+	}
+}
+
+// writeFiller writes n bytes of filler to rw.
+func writeFiller(rw http.ResponseWriter, n int64) error {
+	for n > 0 {
+		b := responseFiller
+		if n < int64(len(b)) {
+			b = b[:n]
+		}
+		if _, err := rw.Write(b); err != nil {
+			return err
+		}
+		n -= int64(len(b))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+type Route struct {
+	Path    string
+	Methods []string
+	Options []func(*ServerOptions)
+}
+
+type routeParameters struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods,omitempty"`
+
+	profileParameters
+}
+
+// buildRoutes builds the routes declared under the routes key of v. Each
+// route has a path, an optional list of methods and the same profile keys as
+// the top-level configuration.
+func buildRoutes(v *viper.Viper) ([]Route, []routeParameters, error) {
+	settings, err := getSettingsList(v, "routes")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	routes := []Route{}
+	parameters := []routeParameters{}
+	paths := map[string]bool{}
+	for _, s := range settings {
+		rv := newProfileViper(s)
+
+		path := rv.GetString("path")
+		if !strings.HasPrefix(path, "/") {
+			return nil, nil, fmt.Errorf("route path must start with /, got: '%s'", path)
+		}
+		if path == adminPathPrefix || strings.HasPrefix(path, adminPathPrefix+"/") {
+			return nil, nil, fmt.Errorf("route path must not be %s or under it, got: '%s'", adminPathPrefix, path)
+		}
+		if paths[path] {
+			return nil, nil, fmt.Errorf("duplicate route path: %s", path)
+		}
+		paths[path] = true
+
+		methods := rv.GetStringSlice("methods")
+		for i, method := range methods {
+			methods[i] = strings.ToUpper(method)
+		}
+
+		profile, err := buildProfile(rv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("route %s: %s", path, err)
+		}
+
+		routes = append(routes, Route{
+			Path:    path,
+			Methods: methods,
+			Options: profile.options,
+		})
+		parameters = append(parameters, routeParameters{
+			Path:              path,
+			Methods:           methods,
+			profileParameters: profile.parameters,
+		})
+	}
+
+	return routes, parameters, nil
+}
+
+type methodMiddleware struct {
+	methods []string
+}
+
+// NewMethodMiddleware returns a middleware rejecting requests whose method is
+// not one of methods with a 405. No methods allows all of them.
+func NewMethodMiddleware(methods []string) *methodMiddleware {
+	return &methodMiddleware{
+		methods: methods,
+	}
+}
+
+func (mm *methodMiddleware) WrapHTTP(next http.Handler) http.Handler {
+	if len(mm.methods) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		for _, method := range mm.methods {
+			if r.Method == method {
+				next.ServeHTTP(rw, r)
+				return
+			}
+		}
+
+		rw.Header().Set("Allow", strings.Join(mm.methods, ", "))
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	})
+}
@@ -1,39 +1,190 @@
 package main
 
 import (
-	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type key int
 
 const (
-	requestIDKey key = 0
-)
-
-var (
-	healthy int32
+	requestIDKey      key = 0
+	connectionKey     key = 1
+	traceContextKey   key = 2
+	requestDetailsKey key = 3
 )
 
 type ServerOptions struct {
 	RateLimiter Middleware
 	Latency     Middleware
 	Error       Middleware
+	Response    Response
+
+	Name      string
+	TLSConfig *tls.Config
+	HTTP2     *http2.Server
+
+	ConnectionFaults ConnectionFaults
+	ConnectionLimit  ConnectionLimit
+	ProxyProtocol    bool
+
+	Drain       Drain
+	Health      Health
+	AccessLog   AccessLog
+	RequestBody RequestBody
+	Timeouts    *Timeouts
+
+	Routes []Route
+	Phases []Phase
+
+	// Settings is the configuration document the options were built from,
+	// reported and updated through the admin API.
+	Settings map[string]interface{}
+}
+
+// Timeouts bound how long the server reads each request, headers and body,
+// writes each response and keeps idle connections open, as those of
+// http.Server. A timeout of 0 disables it.
+type Timeouts struct {
+	Read  time.Duration
+	Write time.Duration
+	Idle  time.Duration
+}
+
+var defaultTimeouts = Timeouts{
+	Read:  5 * time.Second,
+	Write: 10 * time.Second,
+	Idle:  15 * time.Second,
+}
+
+type timeoutsParameters struct {
+	Read  string `json:"read"`
+	Write string `json:"write"`
+	Idle  string `json:"idle"`
+}
+
+// buildTimeouts builds the timeouts of the server described by v.
+func buildTimeouts(v *viper.Viper) (*Timeouts, *timeoutsParameters, error) {
+	timeouts := &Timeouts{
+		Read:  v.GetDuration("timeouts.read"),
+		Write: v.GetDuration("timeouts.write"),
+		Idle:  v.GetDuration("timeouts.idle"),
+	}
+	if timeouts.Read < 0 || timeouts.Write < 0 || timeouts.Idle < 0 {
+		return nil, nil, fmt.Errorf("--read-timeout, --write-timeout and --idle-timeout must be >= 0")
+	}
+
+	return timeouts, &timeoutsParameters{
+		Read:  timeouts.Read.String(),
+		Write: timeouts.Write.String(),
+		Idle:  timeouts.Idle.String(),
+	}, nil
 }
 
 type Server struct {
 	server *http.Server
+	admin  *http.Server
+	router *http.ServeMux
 	logger *log.Logger
 
+	tlsConfig     *tls.Config
+	tlsStatistics *tlsStatistics
+
+	proxyProtocol bool
+
+	connections *connections
+	drain       *drain
+	health      *health
+
 	quit chan (struct{})
 
+	// when the server was created, from which expressions and replays are
+	// timed, including after reloads
+	start time.Time
+
+	routes []*mountedRoute
+
+	eventsMu sync.Mutex
+	events   []*Event
+}
+
+type mountedRoute struct {
+	path                 string
+	methods              []string
+	pipeline             *pipeline
+	phases               []*mountedPhase
 	statisticsMiddleware *statisticsMiddleware
+
+	mu          sync.Mutex
+	base        http.Handler
+	rateLimiter Middleware
+	settings    map[string]interface{}
+	active      *mountedPhase
+}
+
+// enterPhase serves requests to the route using phase, or using the base
+// pipeline if phase is nil.
+func (route *mountedRoute) enterPhase(phase *mountedPhase) {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+
+	route.active = phase
+	if phase != nil {
+		route.pipeline.Store(phase.handler)
+	} else {
+		route.pipeline.Store(route.base)
+	}
+}
+
+// reconfigure replaces the base pipeline of the route and serves requests
+// using it immediately, even if a phase is active. Its rate limiter starts
+// with the tokens left in the one it replaces.
+func (route *mountedRoute) reconfigure(handler http.Handler, rateLimiter Middleware, settings map[string]interface{}) {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+
+	carryOverTokens(rateLimiter, route.rateLimiter)
+	route.base = handler
+	route.rateLimiter = rateLimiter
+	route.settings = settings
+	route.pipeline.Store(handler)
+}
+
+func (route *mountedRoute) Settings() map[string]interface{} {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+	return route.settings
+}
+
+// pipeline serves requests through a handler that can be swapped atomically
+// while requests are in flight.
+type pipeline struct {
+	handler atomic.Value
+}
+
+func newPipeline(handler http.Handler) *pipeline {
+	p := &pipeline{}
+	p.Store(handler)
+	return p
+}
+
+func (p *pipeline) Store(handler http.Handler) {
+	p.handler.Store(&handler)
+}
+
+func (p *pipeline) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	(*p.handler.Load().(*http.Handler)).ServeHTTP(rw, r)
 }
 
 type Middleware interface {
@@ -49,7 +200,12 @@ func (s *Server) Listen(listener net.Listener) {
 		for {
 			select {
 			case <-ticker.C:
-				log.Printf("Received %v messages across %v requests", s.statisticsMiddleware.MessageCount(), s.statisticsMiddleware.RequestCount())
+				var messageCount, requestCount int64
+				for _, route := range s.routes {
+					messageCount += route.statisticsMiddleware.MessageCount()
+					requestCount += route.statisticsMiddleware.RequestCount()
+				}
+				log.Printf("Received %v messages across %v requests", messageCount, requestCount)
 			case <-s.quit:
 				ticker.Stop()
 				return
@@ -57,21 +213,77 @@ func (s *Server) Listen(listener net.Listener) {
 		}
 	}()
 
+	start := time.Now()
+	for _, route := range s.routes {
+		if len(route.phases) > 0 {
+			go s.runPhases(route, start)
+		}
+	}
+
+	go s.connections.sample(time.Second, s.quit)
+
+	listener = s.connections.Listener(listener)
+	if s.proxyProtocol {
+		listener = newProxyListener(listener, s.connections)
+	}
+	if s.tlsConfig != nil {
+		listener = newTLSListener(listener, s.tlsConfig, s.tlsStatistics)
+	}
+
 	s.logger.Println("Server is ready to handle requests at", listener.Addr().String())
-	atomic.StoreInt32(&healthy, 1)
+	s.health.Listening(start)
 	if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
 		s.logger.Fatalf("Could not listen on %s: %v\n", s.server.Addr, err)
 	}
 }
 
+// ListenAdmin serves the admin API on listener in addition to the reserved
+// path prefix of the main listener.
+func (s *Server) ListenAdmin(listener net.Listener) {
+	s.logger.Println("Admin API is ready to handle requests at", listener.Addr().String())
+	if err := s.admin.Serve(listener); err != nil && err != http.ErrServerClosed {
+		s.logger.Fatalf("Could not listen on %s: %v\n", listener.Addr().String(), err)
+	}
+}
+
+// Statistics returns the statistics of the server. When more than one route
+// is mounted, the top-level statistics are the totals across all routes and
+// the statistics of each route are given by path.
 func (s *Server) Statistics() Statistics {
-	return s.statisticsMiddleware.Statistics()
+	var statistics Statistics
+	if len(s.routes) == 1 {
+		statistics = s.routes[0].statisticsMiddleware.Statistics()
+	} else {
+		byRoute := map[string]Statistics{}
+		for _, route := range s.routes {
+			byRoute[route.path] = route.statisticsMiddleware.Statistics()
+		}
+
+		statistics = mergeStatistics(byRoute)
+		statistics.Routes = byRoute
+	}
+
+	statistics.Events = s.Events()
+	statistics.Connections = s.connections.Statistics()
+	statistics.Drain = s.drain.Statistics()
+	statistics.Health = s.health.Statistics()
+	if s.tlsStatistics != nil {
+		statistics.TLS = s.tlsStatistics.Statistics()
+	}
+	return statistics
 }
 
-func (s *Server) Shutdown(ctx context.Context) error {
-	close(s.quit)
-	s.server.SetKeepAlivesEnabled(false)
-	return s.server.Shutdown(ctx)
+// Events returns the events recorded so far, such as phase boundaries.
+func (s *Server) Events() []*Event {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	return append([]*Event{}, s.events...)
+}
+
+func (s *Server) recordEvent(event *Event) {
+	s.eventsMu.Lock()
+	defer s.eventsMu.Unlock()
+	s.events = append(s.events, event)
 }
 
 func (s *Server) Index(w http.ResponseWriter, r *http.Request) {
@@ -79,14 +291,6 @@ func (s *Server) Index(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "")
 }
 
-func (s *Server) Health(w http.ResponseWriter, r *http.Request) {
-	if atomic.LoadInt32(&healthy) == 1 {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	w.WriteHeader(http.StatusServiceUnavailable)
-}
-
 func WithLatency(latency Middleware) func(*ServerOptions) {
 	return func(s *ServerOptions) {
 		s.Latency = latency
@@ -105,84 +309,300 @@ func WithError(errorer Middleware) func(*ServerOptions) {
 	}
 }
 
-func NewServer(opts ...func(*ServerOptions)) *Server {
-	logger := log.New(os.Stdout, "http: ", log.LstdFlags)
-	logger.Println("Server is starting...")
+// WithRoute mounts an additional route at path with its own latency, error
+// and rate limit behavior and its own statistics. Only requests using one of
+// methods are accepted, unless methods is empty.
+func WithRoute(path string, methods []string, opts ...func(*ServerOptions)) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.Routes = append(s.Routes, Route{
+			Path:    path,
+			Methods: methods,
+			Options: opts,
+		})
+	}
+}
 
-	router := http.NewServeMux()
+// WithName names the server, for servers run alongside others.
+func WithName(name string) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.Name = name
+	}
+}
 
-	nextRequestID := func() string {
-		return fmt.Sprintf("%d", time.Now().UnixNano())
+// WithTLSConfig serves requests over TLS using config. Handshakes are
+// recorded in the statistics of the server.
+func WithTLSConfig(config *tls.Config) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.TLSConfig = config
 	}
+}
 
-	httpServer := &http.Server{
-		Handler:      tracing(nextRequestID)(logging(logger)(router)),
-		ErrorLog:     logger,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+// WithHTTP2 serves requests over HTTP/2 using config, in addition to
+// HTTP/1.x: negotiated through ALPN over TLS and as h2c otherwise.
+func WithHTTP2(config *http2.Server) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.HTTP2 = config
 	}
+}
 
-	server := Server{
-		server: httpServer,
-		logger: logger,
+// WithConnectionFaults injects faults at the connection level, across all
+// routes. Each fault is counted in the statistics of the server.
+func WithConnectionFaults(faults ConnectionFaults) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.ConnectionFaults = faults
+	}
+}
 
-		statisticsMiddleware: newStatisticsMiddleware(),
+// WithConnectionLimit caps the number of connections served at once.
+func WithConnectionLimit(limit ConnectionLimit) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.ConnectionLimit = limit
 	}
+}
 
-	errorExpressionMiddleware, err := NewErrorExpressionMiddleware("false")
+// WithProxyProtocol reads the client address of each connection from the
+// PROXY protocol header sent by a load balancer in front of the server.
+func WithProxyProtocol() func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.ProxyProtocol = true
+	}
+}
+
+// WithDrain sets how the server is drained when it shuts down.
+func WithDrain(drain Drain) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.Drain = drain
+	}
+}
+
+// WithHealth sets the health check endpoints of the server and how they
+// respond.
+func WithHealth(health Health) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.Health = health
+	}
+}
+
+// WithAccessLog sets the format, destination and sampling of the access log.
+func WithAccessLog(accessLog AccessLog) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.AccessLog = accessLog
+	}
+}
+
+// WithRequestBody sets how request bodies are read.
+func WithRequestBody(requestBody RequestBody) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.RequestBody = requestBody
+	}
+}
+
+// WithTimeouts sets how long the server reads requests and writes responses
+// for.
+func WithTimeouts(timeouts Timeouts) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.Timeouts = &timeouts
+	}
+}
+
+func WithSettings(settings map[string]interface{}) func(*ServerOptions) {
+	return func(s *ServerOptions) {
+		s.Settings = settings
+	}
+}
+
+func defaultServerOptions() ServerOptions {
+	errorExpressionMiddleware, err := NewErrorExpressionMiddleware("false", nil)
 	if err != nil {
 		panic(err) // should never happen
 	}
 
-	serverOptions := ServerOptions{
+	return ServerOptions{
 		RateLimiter: &RateLimiterNone{},
 		Latency:     NewLatencyMiddlewareNormal(time.Duration(0), time.Duration(0)),
 		Error:       errorExpressionMiddleware,
 	}
+}
 
+func NewServer(opts ...func(*ServerOptions)) *Server {
+	serverOptions := ServerOptions{}
 	for _, opt := range opts {
 		opt(&serverOptions)
 	}
 
-	var indexHandler http.Handler = http.HandlerFunc(server.Index)
-	indexHandler = serverOptions.Latency.WrapHTTP(indexHandler)
-	indexHandler = serverOptions.Error.WrapHTTP(indexHandler)
-	indexHandler = serverOptions.RateLimiter.WrapHTTP(indexHandler)
-	indexHandler = server.statisticsMiddleware.WrapHTTP(indexHandler)
-	indexHandler = NewCompressionMiddleware().WrapHTTP(indexHandler)
-	router.Handle("/", indexHandler)
+	prefix := "http: "
+	if serverOptions.Name != "" {
+		prefix = fmt.Sprintf("http[%s]: ", serverOptions.Name)
+	}
+	logger := log.New(os.Stdout, prefix, log.LstdFlags)
+	logger.Println("Server is starting...")
+
+	router := http.NewServeMux()
+
+	connections := newConnections(serverOptions.ConnectionFaults, serverOptions.ConnectionLimit)
+	drain := newDrain(serverOptions.Drain)
+	accessLog := newAccessLog(serverOptions.AccessLog, serverOptions.Name, logger)
+	requestBody := newRequestBodyThrottle(serverOptions.RequestBody)
+
+	timeouts := defaultTimeouts
+	if serverOptions.Timeouts != nil {
+		timeouts = *serverOptions.Timeouts
+	}
+
+	httpServer := &http.Server{
+		Handler:      tracing(nextRequestID)(accessLog.WrapHTTP(connections.WrapHTTP(drain.WrapHTTP(requestBody.WrapHTTP(router))))),
+		ConnState:    connections.ConnState,
+		ErrorLog:     logger,
+		ReadTimeout:  timeouts.Read,
+		WriteTimeout: timeouts.Write,
+		IdleTimeout:  timeouts.Idle,
+	}
+
+	server := Server{
+		server:      httpServer,
+		router:      router,
+		logger:      logger,
+		connections: connections,
+		drain:       drain,
+		health:      newHealth(serverOptions.Health),
+		start:       time.Now(),
+
+		proxyProtocol: serverOptions.ProxyProtocol,
+	}
+
+	if serverOptions.TLSConfig != nil {
+		server.tlsConfig = serverOptions.TLSConfig
+		server.tlsStatistics = newTLSStatistics()
+	}
+
+	if serverOptions.HTTP2 != nil {
+		if err := http2.ConfigureServer(httpServer, serverOptions.HTTP2); err != nil {
+			panic(err) // should never happen
+		}
+
+		// negotiate h2 over TLS, or accept h2c otherwise
+		if server.tlsConfig != nil {
+			server.tlsConfig = server.tlsConfig.Clone()
+			server.tlsConfig.NextProtos = append([]string{http2.NextProtoTLS}, server.tlsConfig.NextProtos...)
+		} else {
+			httpServer.Handler = h2c.NewHandler(httpServer.Handler, serverOptions.HTTP2)
+		}
+	}
+
+	for _, route := range routes(opts) {
+		server.handle(route)
+	}
+
+	router.Handle(server.health.options.Path, server.health.handler(healthProbe, server.healthStatus))
+	if path := server.health.options.LivenessPath; path != "" {
+		router.Handle(path, server.health.handler(livenessProbe, server.livenessStatus))
+	}
+	if path := server.health.options.ReadinessPath; path != "" {
+		router.Handle(path, server.health.handler(readinessProbe, server.readinessStatus))
+	}
+	for _, path := range server.health.Paths() {
+		drain.exempt[path] = true
+	}
+	router.HandleFunc(adminPathPrefix+"/", server.Admin)
 
-	router.HandleFunc("/_health", server.Health)
+	adminRouter := http.NewServeMux()
+	adminRouter.HandleFunc(adminPathPrefix+"/", server.Admin)
+	server.admin = &http.Server{
+		Handler:  accessLog.WrapHTTP(adminRouter),
+		ErrorLog: logger,
+	}
 
 	return &server
 }
 
-func logging(logger *log.Logger) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			defer func() {
-				requestID, ok := r.Context().Value(requestIDKey).(string)
-				if !ok {
-					requestID = "unknown"
-				}
-				logger.Println(requestID, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
-			}()
-			next.ServeHTTP(w, r)
-		})
+// routes returns the routes described by opts, including the top-level route
+// at / unless one is declared.
+func routes(opts []func(*ServerOptions)) []Route {
+	serverOptions := ServerOptions{}
+	for _, opt := range opts {
+		opt(&serverOptions)
 	}
+
+	routes := serverOptions.Routes
+	for _, route := range routes {
+		if route.Path == "/" {
+			return routes
+		}
+	}
+	return append(routes, Route{Path: "/", Options: opts})
 }
 
-func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			requestID := r.Header.Get("X-Request-Id")
-			if requestID == "" {
-				requestID = nextRequestID()
-			}
-			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
-			w.Header().Set("X-Request-Id", requestID)
-			next.ServeHTTP(w, r.WithContext(ctx))
+func resolveOptions(opts []func(*ServerOptions)) ServerOptions {
+	serverOptions := defaultServerOptions()
+	for _, opt := range opts {
+		opt(&serverOptions)
+	}
+	return serverOptions
+}
+
+// handle mounts the request pipeline described by r.
+func (s *Server) handle(r Route) {
+	serverOptions := resolveOptions(r.Options)
+
+	base := s.buildPipeline(serverOptions)
+	route := &mountedRoute{
+		path:                 r.Path,
+		methods:              r.Methods,
+		pipeline:             newPipeline(base),
+		statisticsMiddleware: newStatisticsMiddleware(),
+		base:                 base,
+		rateLimiter:          serverOptions.RateLimiter,
+		settings:             serverOptions.Settings,
+	}
+
+	for _, phase := range serverOptions.Phases {
+		phaseOptions := resolveOptions(phase.Options)
+		route.phases = append(route.phases, &mountedPhase{
+			Phase:       phase,
+			handler:     s.buildPipeline(phaseOptions),
+			rateLimiter: phaseOptions.RateLimiter,
 		})
 	}
+
+	var handler http.Handler = route.pipeline
+	handler = NewMethodMiddleware(r.Methods).WrapHTTP(handler)
+	handler = route.statisticsMiddleware.WrapHTTP(handler)
+	handler = NewCompressionMiddleware().WrapHTTP(handler)
+
+	next := handler
+	s.router.Handle(r.Path, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		detailsFromRequest(r).setRoute(route.path)
+		next.ServeHTTP(rw, r)
+	}))
+
+	s.routes = append(s.routes, route)
+}
+
+// startedMiddleware is implemented by middlewares whose behavior depends on how
+// long the server has been running.
+type startedMiddleware interface {
+	startAt(start time.Time)
+}
+
+// buildPipeline builds the rate limit, error and latency behavior described by
+// serverOptions in front of the index handler. Time in the middlewares runs
+// from the start of the server, so rebuilding them does not start it over.
+func (s *Server) buildPipeline(serverOptions ServerOptions) http.Handler {
+	for _, middleware := range []Middleware{serverOptions.Latency, serverOptions.Error} {
+		if m, ok := middleware.(startedMiddleware); ok {
+			m.startAt(s.start)
+		}
+	}
+	if rl, ok := serverOptions.RateLimiter.(bucketLimiter); ok {
+		rl.rateLimitBuckets().startAt(s.start)
+	}
+
+	var handler http.Handler = http.HandlerFunc(s.Index)
+	if serverOptions.Response != (Response{}) {
+		handler = newResponder(serverOptions.Response)
+	}
+	handler = serverOptions.Latency.WrapHTTP(handler)
+	handler = serverOptions.Error.WrapHTTP(handler)
+	handler = serverOptions.RateLimiter.WrapHTTP(handler)
+	return handler
 }
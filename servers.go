@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// virtualServer is one of the servers run by a single invocation, each bound
+// to its own address with its own options and statistics.
+type virtualServer struct {
+	name        string
+	summaryPath string
+
+	server        *Server
+	listener      net.Listener
+	adminListener net.Listener
+	parameters    *parameters
+}
+
+type serversParameters struct {
+	Config  *string                `json:"config,omitempty"`
+	Servers map[string]*parameters `json:"servers"`
+}
+
+type serversStatistics struct {
+	Servers map[string]Statistics `json:"servers"`
+}
+
+// serverConfigs returns the configuration of each server described by v: the
+// servers declared under the servers key, by name, or else a single unnamed
+// server using the top-level options.
+func serverConfigs(v *viper.Viper) ([]string, []*viper.Viper, error) {
+	settings, err := getSettingsList(v, "servers")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(settings) == 0 {
+		return []string{""}, []*viper.Viper{v}, nil
+	}
+
+	names := []string{}
+	configs := []*viper.Viper{}
+	seen := map[string]bool{}
+	for i, s := range settings {
+		sv := newServerViper(s)
+
+		name := sv.GetString("name")
+		if name == "" {
+			name = fmt.Sprintf("server-%d", i)
+		}
+		if seen[name] {
+			return nil, nil, fmt.Errorf("server %s is declared more than once", name)
+		}
+		seen[name] = true
+
+		if sv.GetString("address") == "" {
+			return nil, nil, fmt.Errorf("server %s: address is required", name)
+		}
+
+		names = append(names, name)
+		configs = append(configs, sv)
+	}
+
+	return names, configs, nil
+}
+
+// newVirtualServer builds the server described by v and binds its listeners.
+// Servers serving TLS without a certificate of their own are issued one by the
+// certificate authority returned by ca.
+func newVirtualServer(name string, v *viper.Viper, ca func() (*certificateAuthority, error)) (*virtualServer, error) {
+	opts, parameters, err := buildVirtualServerOptions(name, v, ca)
+	if err != nil {
+		return nil, err
+	}
+
+	errorf := serverErrorf(name)
+
+	vs := &virtualServer{
+		name:        name,
+		summaryPath: v.GetString("summary-path"),
+		parameters:  parameters,
+	}
+
+	vs.listener, err = listen(v.GetString("address"))
+	if err != nil {
+		return nil, errorf("could not bind to address: %s", err)
+	}
+	parameters.Address = listenerAddress(vs.listener)
+
+	if adminAddress := v.GetString("admin-address"); adminAddress != "" {
+		vs.adminListener, err = listen(adminAddress)
+		if err != nil {
+			return nil, errorf("could not bind admin API to address: %s", err)
+		}
+
+		address := listenerAddress(vs.adminListener)
+		parameters.AdminAddress = &address
+	}
+
+	vs.server = NewServer(opts...)
+
+	return vs, nil
+}
+
+// buildVirtualServerOptions builds the options of the server described by v,
+// as newVirtualServer does, without binding its listeners.
+func buildVirtualServerOptions(name string, v *viper.Viper, ca func() (*certificateAuthority, error)) ([]func(*ServerOptions), *parameters, error) {
+	errorf := serverErrorf(name)
+
+	opts, parameters, err := buildServerOptions(v)
+	if err != nil {
+		return nil, nil, errorf("%s", err)
+	}
+	opts = append(opts, WithName(name))
+
+	tlsConfig, tlsParameters, err := buildTLSConfig(v, ca)
+	if err != nil {
+		return nil, nil, errorf("%s", err)
+	}
+	if tlsConfig != nil {
+		opts = append(opts, WithTLSConfig(tlsConfig))
+		parameters.TLS = tlsParameters
+	}
+
+	if http2Config, http2Parameters := buildHTTP2Config(v); http2Config != nil {
+		opts = append(opts, WithHTTP2(http2Config))
+		parameters.HTTP2 = http2Parameters
+	}
+
+	faults, connectionParameters, err := buildConnectionFaults(v)
+	if err != nil {
+		return nil, nil, errorf("%s", err)
+	}
+	if faults != nil {
+		opts = append(opts, WithConnectionFaults(*faults))
+		parameters.Connection = connectionParameters
+	}
+
+	limit, connectionLimitParameters, err := buildConnectionLimit(v)
+	if err != nil {
+		return nil, nil, errorf("%s", err)
+	}
+	if limit != nil {
+		opts = append(opts, WithConnectionLimit(*limit))
+		parameters.ConnectionLimit = connectionLimitParameters
+	}
+
+	if v.GetBool("proxy-protocol.enabled") {
+		opts = append(opts, WithProxyProtocol())
+		parameters.ProxyProtocol = true
+	}
+
+	drain, drainParameters, err := buildDrain(v)
+	if err != nil {
+		return nil, nil, errorf("%s", err)
+	}
+	opts = append(opts, WithDrain(*drain))
+	parameters.Drain = drainParameters
+
+	health, healthParameters, err := buildHealth(v)
+	if err != nil {
+		return nil, nil, errorf("%s", err)
+	}
+	for _, route := range parameters.Routes {
+		for _, path := range []string{health.Path, health.LivenessPath, health.ReadinessPath} {
+			if path == route.Path {
+				return nil, nil, errorf("health check path %s is also a route", path)
+			}
+		}
+	}
+	opts = append(opts, WithHealth(*health))
+	parameters.Health = healthParameters
+
+	accessLog, accessLogParameters, err := buildAccessLog(v)
+	if err != nil {
+		return nil, nil, errorf("%s", err)
+	}
+	opts = append(opts, WithAccessLog(*accessLog))
+	parameters.AccessLog = accessLogParameters
+
+	timeouts, timeoutsParameters, err := buildTimeouts(v)
+	if err != nil {
+		return nil, nil, errorf("%s", err)
+	}
+	opts = append(opts, WithTimeouts(*timeouts))
+	parameters.Timeouts = timeoutsParameters
+
+	requestBody, requestBodyParameters, err := buildRequestBody(v)
+	if err != nil {
+		return nil, nil, errorf("%s", err)
+	}
+	if requestBody != nil {
+		opts = append(opts, WithRequestBody(*requestBody))
+		parameters.RequestBody = requestBodyParameters
+	}
+
+	return opts, parameters, nil
+}
+
+// serverErrorf returns a function formatting errors about the server name,
+// prefixed by its name if it has one.
+func serverErrorf(name string) func(format string, a ...interface{}) error {
+	return func(format string, a ...interface{}) error {
+		if name != "" {
+			format = "server " + name + ": " + format
+		}
+		return fmt.Errorf(format, a...)
+	}
+}
+
+// unixAddressPrefix marks addresses of unix domain sockets, given by path.
+const unixAddressPrefix = "unix://"
+
+// listen binds to address: a TCP host:port or unix:///path/to.sock for a unix
+// domain socket. A socket file left over by a previous run that is no longer
+// listened on is replaced. The socket file is removed when the listener is
+// closed.
+func listen(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, unixAddressPrefix) {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, unixAddressPrefix)
+	if path == "" {
+		return nil, fmt.Errorf("no socket path given in %s", address)
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// listenerAddress returns the address listener is bound to, in the form
+// given to listen.
+func listenerAddress(listener net.Listener) string {
+	addr := listener.Addr()
+	if addr.Network() == "unix" {
+		return unixAddressPrefix + addr.String()
+	}
+	return addr.String()
+}
+
+func (vs *virtualServer) Listen() {
+	go func() {
+		vs.server.Listen(vs.listener)
+	}()
+
+	if vs.adminListener != nil {
+		go func() {
+			vs.server.ListenAdmin(vs.adminListener)
+		}()
+	}
+}
+
+// reloadServers rebuilds the options of each of servers from v. Either all of
+// servers are reloaded, or none of them is.
+func reloadServers(v *viper.Viper, servers []*virtualServer) error {
+	names, configs, err := serverConfigs(v)
+	if err != nil {
+		return err
+	}
+	if len(names) != len(servers) {
+		return fmt.Errorf("servers cannot be added or removed by a reload")
+	}
+
+	opts := make([][]func(*ServerOptions), len(servers))
+	for i, vs := range servers {
+		if names[i] != vs.name {
+			return fmt.Errorf("servers cannot be added or removed by a reload")
+		}
+
+		opts[i], _, err = buildServerOptions(configs[i])
+		if err != nil {
+			return serverErrorf(vs.name)("%s", err)
+		}
+	}
+
+	swaps := make([]func(), len(servers))
+	for i, vs := range servers {
+		swaps[i], err = vs.server.prepareReload(opts[i]...)
+		if err != nil {
+			return serverErrorf(vs.name)("%s", err)
+		}
+	}
+	for _, swap := range swaps {
+		swap()
+	}
+
+	return nil
+}
+
+// writeParameters writes the parameters of servers to path. A single unnamed
+// server is written as is, named servers are keyed by name.
+func writeParameters(path string, config *string, servers []*virtualServer) error {
+	var out interface{}
+	if len(servers) == 1 && servers[0].name == "" {
+		servers[0].parameters.Config = config
+		out = servers[0].parameters
+	} else {
+		parameters := &serversParameters{
+			Config:  config,
+			Servers: map[string]*parameters{},
+		}
+		for _, vs := range servers {
+			parameters.Servers[vs.name] = vs.parameters
+		}
+		out = parameters
+	}
+
+	b, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// shutdownServers drains and shuts down all of servers concurrently, each
+// within its own drain timeout.
+func shutdownServers(ctx context.Context, servers []*virtualServer) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(servers))
+	for i, vs := range servers {
+		wg.Add(1)
+		go func(i int, vs *virtualServer) {
+			defer wg.Done()
+			errs[i] = vs.server.Shutdown(ctx)
+		}(i, vs)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSummaries writes the statistics of servers. A single unnamed server is
+// written to summaryPath as is. Named servers are written to their own
+// summary path if they have one, and the others to summaryPath keyed by name.
+func writeSummaries(summaryPath string, servers []*virtualServer) error {
+	write := func(path string, statistics interface{}) error {
+		b, err := json.Marshal(statistics)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote activity summary to %s\n", path)
+		return nil
+	}
+
+	if len(servers) == 1 && servers[0].name == "" {
+		return write(summaryPath, servers[0].server.Statistics())
+	}
+
+	combined := &serversStatistics{
+		Servers: map[string]Statistics{},
+	}
+	for _, vs := range servers {
+		if vs.summaryPath == "" {
+			combined.Servers[vs.name] = vs.server.Statistics()
+			continue
+		}
+		if err := write(vs.summaryPath, vs.server.Statistics()); err != nil {
+			return err
+		}
+	}
+	if len(combined.Servers) > 0 {
+		return write(summaryPath, combined)
+	}
+
+	return nil
+}
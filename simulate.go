@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate",
+	Short: "Preview the latency and error behavior of the configuration offline.",
+	Long: `Preview the latency and error behavior of the configuration offline.
+
+The configured latency and error expressions of every route and phase are
+evaluated over a range of t and active_requests values, sampling each point
+several times, and a CSV with the mean, p50 and p99 latency in ms and the
+error probability at each point is written to stdout.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var (
+			activeRequestsMin, _  = cmd.Flags().GetUint("active-requests-min")
+			activeRequestsMax, _  = cmd.Flags().GetUint("active-requests-max")
+			activeRequestsStep, _ = cmd.Flags().GetUint("active-requests-step")
+			tMax, _               = cmd.Flags().GetDuration("t-max")
+			tStep, _              = cmd.Flags().GetDuration("t-step")
+		)
+		if activeRequestsStep == 0 || tStep <= 0 {
+			return fmt.Errorf("--active-requests-step and --t-step must be > 0")
+		}
+
+		grid := expressionGrid{}
+		grid.samples, _ = cmd.Flags().GetInt("samples")
+		if grid.samples < 1 {
+			return fmt.Errorf("--samples must be >= 1, got: %d", grid.samples)
+		}
+		for a := activeRequestsMin; a <= activeRequestsMax; a += activeRequestsStep {
+			grid.activeRequests = append(grid.activeRequests, a)
+		}
+		for t := time.Duration(0); t <= tMax; t += tStep {
+			grid.t = append(grid.t, t)
+		}
+
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"server", "route", "phase", "t", "active_requests", "latency_mean_ms", "latency_p50_ms", "latency_p99_ms", "error_probability"})
+
+		err := eachProfile(viper.GetViper(), func(location profileLocation, serverOptions ServerOptions) {
+			grid.eachPoint(func(parameters *expressionParameters) {
+				s := grid.simulate(serverOptions, parameters)
+				w.Write([]string{
+					location.server,
+					location.route,
+					location.phase,
+					strconv.FormatInt(int64(parameters.t/time.Second), 10),
+					strconv.FormatUint(uint64(parameters.activeRequests), 10),
+					formatMs(s.mean),
+					formatMs(s.p50),
+					formatMs(s.p99),
+					strconv.FormatFloat(s.errorProbability, 'f', 4, 64),
+				})
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		w.Flush()
+		return w.Error()
+	},
+}
+
+type simulation struct {
+	mean, p50, p99   time.Duration
+	errorProbability float64
+}
+
+// simulate samples the latency and error behavior of serverOptions at a
+// single point. Samples that fail to evaluate count as errors, as they do when
+// serving requests.
+func (g expressionGrid) simulate(serverOptions ServerOptions, parameters *expressionParameters) simulation {
+	latencies := []time.Duration{}
+	errors := 0
+
+	for i := 0; i < g.samples; i++ {
+		if em, ok := serverOptions.Error.(*ErrorExpressionMiddleware); ok {
+			v, err := em.evaluate(parameters)
+			if err != nil || v != false {
+				errors++
+				continue
+			}
+		}
+
+		if ls, ok := serverOptions.Latency.(latencySampler); ok {
+			d, err := ls.sample(parameters)
+			if err != nil {
+				errors++
+				continue
+			}
+			if d < 0 {
+				d = 0 // sleeping for a negative duration returns immediately
+			}
+			latencies = append(latencies, d)
+		}
+	}
+
+	s := simulation{
+		errorProbability: float64(errors) / float64(g.samples),
+	}
+	if len(latencies) == 0 {
+		return s
+	}
+
+	sort.Slice(latencies, func(i, j int) bool {
+		return latencies[i] < latencies[j]
+	})
+
+	var total time.Duration
+	for _, d := range latencies {
+		total += d
+	}
+	s.mean = total / time.Duration(len(latencies))
+	s.p50 = percentile(latencies, 0.5)
+	s.p99 = percentile(latencies, 0.99)
+
+	return s
+}
+
+// percentile returns the nearest-rank percentile p of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func formatMs(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
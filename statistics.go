@@ -3,9 +3,12 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -18,13 +21,63 @@ type Statistics struct {
 	MessageCount int64  `json:"message_count"`
 	RequestCount int64  `json:"request_count"`
 
+	// requests whose client went away before they were fully responded to
+	ClientAbortCount int64 `json:"client_abort_count,omitempty"`
+
 	Requests []*RequestStatistics `json:"requests"`
+
+	Routes map[string]Statistics `json:"routes,omitempty"`
+	Events []*Event              `json:"events,omitempty"`
+	TLS    *TLSStatistics        `json:"tls,omitempty"`
+
+	Connections *ConnectionStatistics `json:"connections,omitempty"`
+	Drain       *DrainStatistics      `json:"drain,omitempty"`
+	Health      *HealthStatistics     `json:"health,omitempty"`
 }
 
+// Event marks a change in server behavior, such as a phase boundary, so it
+// can be correlated with the requests around it.
+type Event struct {
+	Time  time.Time `json:"time"`
+	Type  string    `json:"type"`
+	Route string    `json:"route,omitempty"`
+	Name  string    `json:"name,omitempty"`
+}
+
+const (
+	EventPhaseStart = "phase_start"
+	EventPhaseEnd   = "phase_end"
+
+	EventReconfigure = "reconfigure"
+	EventReload      = "reload"
+)
+
 type RequestStatistics struct {
 	Start  time.Time `json:"start"`
 	End    time.Time `json:"end"`
 	Status int       `json:"status"`
+
+	RequestID  string `json:"request_id"`
+	RemoteAddr string `json:"remote_addr"`
+	TraceID    string `json:"trace_id,omitempty"`
+	ParentID   string `json:"parent_id,omitempty"`
+	TraceState string `json:"trace_state,omitempty"`
+
+	Proto    string `json:"proto"`
+	StreamID uint32 `json:"stream_id,omitempty"`
+
+	// the latency injected into the request
+	LatencyMs *float64 `json:"latency_ms,omitempty"`
+
+	ResponseBytes int64 `json:"response_bytes,omitempty"`
+
+	// client_aborted if the client went away before the request was fully
+	// responded to, at AbortedAt
+	Outcome   string     `json:"outcome,omitempty"`
+	AbortedAt *time.Time `json:"aborted_at,omitempty"`
+
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
 }
 
 // TODO(jesse) consider moving Statistics to handler with channel to avoid
@@ -46,47 +99,65 @@ func (sm *statisticsMiddleware) WrapHTTP(next http.Handler) http.Handler {
 			startTime:     time.Now(),
 			contentType:   r.Header.Get("Content-Type"),
 			contentLength: r.Header.Get("Content-Length"),
+			proto:         r.Proto,
+			tls:           r.TLS,
+			requestID:     requestID(r),
+			remoteAddr:    r.RemoteAddr,
+			traceContext:  requestTraceContext(r),
 		}
 
 		var b bytes.Buffer
 		_, err := b.ReadFrom(r.Body)
 		if err != nil {
+			// requests whose client went away while their body was read,
+			// such as one throttled, are recorded as aborted
+			if details := detailsFromRequest(r); checkBodyAborted(r, err) && details != nil {
+				handledRequest.abortedAt = details.abortedAt
+				handledRequest.endTime = time.Now()
+				go sm.recordRequest(handledRequest)
+				return
+			}
 			handledRequest.statusCode = http.StatusBadRequest
 			http.Error(rw, "can't read body", http.StatusBadRequest)
 			return
 		}
 		r.Body = ioutil.NopCloser(&b)
 		handledRequest.body = b.Bytes()
+		handledRequest.messages = splitMessages(handledRequest.contentType, handledRequest.body)
+		detailsFromRequest(r).setBody(len(handledRequest.body), len(handledRequest.messages))
 
-		wrapper := &responseWriterWrapper{ResponseWriter: rw}
+		if r.ProtoMajor == 2 {
+			handledRequest.streamID, _ = http2StreamID(rw)
+		}
 
-		next.ServeHTTP(wrapper, r)
+		wrapper := &responseWriterWrapper{ResponseWriter: rw}
 
-		handledRequest.statusCode = wrapper.status
-		handledRequest.endTime = time.Now()
-		go func() {
-			sm.recordRequest(handledRequest)
+		// requests aborted by panicking, such as reset streams, are recorded
+		// too, without a status as no response was sent
+		completed := false
+		defer func() {
+			if completed {
+				handledRequest.statusCode = wrapper.status
+			}
+			handledRequest.responseBytes = wrapper.written
+			if details := detailsFromRequest(r); details != nil {
+				handledRequest.latency = details.latency
+				handledRequest.abortedAt = details.abortedAt
+			}
+			handledRequest.endTime = time.Now()
+			go func() {
+				sm.recordRequest(handledRequest)
+			}()
 		}()
+
+		next.ServeHTTP(wrapper, r)
+		completed = true
 	})
 }
 
 func (sm *statisticsMiddleware) recordRequest(r *handledRequest) {
 	byteLen := len(r.body)
-	body := string(r.body)
-	messages := []string{}
-
-	switch r.contentType {
-	// Unfortunately fluentbit does not use the proper content type when sending
-	// new line delimited JSON :(
-	case "application/json":
-		messages = strings.Split(body, "\n")
-	case "application/ndjson":
-		messages = strings.Split(body, "\n")
-	case "application/x-ndjson":
-		messages = strings.Split(body, "\n")
-	case "text/plain":
-		messages = strings.Split(body, "\n")
-	}
+	messages := r.messages
 
 	messageCount := len(messages)
 	firstMessage := ""
@@ -111,11 +182,51 @@ func (sm *statisticsMiddleware) recordRequest(r *handledRequest) {
 		sm.statistics.LastMessage = lastMessage
 	}
 
-	sm.statistics.Requests = append(sm.statistics.Requests, &RequestStatistics{
+	requestStatistics := &RequestStatistics{
 		Start:  r.startTime.UTC(),
 		End:    r.endTime.UTC(),
 		Status: r.statusCode,
-	})
+
+		RequestID:  r.requestID,
+		RemoteAddr: r.remoteAddr,
+
+		Proto:    r.proto,
+		StreamID: r.streamID,
+
+		ResponseBytes: r.responseBytes,
+	}
+	if r.latency != nil {
+		latencyMs := durationMs(*r.latency)
+		requestStatistics.LatencyMs = &latencyMs
+	}
+	if r.abortedAt != nil {
+		sm.statistics.ClientAbortCount++
+		abortedAt := r.abortedAt.UTC()
+		requestStatistics.Outcome = outcomeClientAborted
+		requestStatistics.AbortedAt = &abortedAt
+	}
+	if r.traceContext != nil {
+		requestStatistics.TraceID = r.traceContext.TraceID
+		requestStatistics.ParentID = r.traceContext.ParentID
+		requestStatistics.TraceState = r.traceContext.State
+	}
+	if r.tls != nil {
+		requestStatistics.TLSVersion = tlsVersionName(r.tls.Version)
+		requestStatistics.TLSCipherSuite = tlsCipherSuiteName(r.tls.CipherSuite)
+	}
+	sm.statistics.Requests = append(sm.statistics.Requests, requestStatistics)
+}
+
+// splitMessages splits body into the messages it carries, one per line, for
+// the content types known to be sent as newline delimited messages.
+func splitMessages(contentType string, body []byte) []string {
+	switch contentType {
+	// Unfortunately fluentbit does not use the proper content type when sending
+	// new line delimited JSON :(
+	case "application/json", "application/ndjson", "application/x-ndjson", "text/plain":
+		return strings.Split(string(body), "\n")
+	}
+	return []string{}
 }
 
 func (sm *statisticsMiddleware) MessageCount() int64 {
@@ -136,13 +247,58 @@ func (sm *statisticsMiddleware) Statistics() Statistics {
 	return *sm.statistics
 }
 
+// mergeStatistics returns the totals across all of statistics. The requests
+// of each are merged in order of their start time.
+func mergeStatistics(statistics map[string]Statistics) Statistics {
+	merged := Statistics{
+		Requests: []*RequestStatistics{},
+	}
+
+	var firstStart, lastEnd time.Time
+	for _, s := range statistics {
+		merged.ByteTotal += s.ByteTotal
+		merged.MessageCount += s.MessageCount
+		merged.RequestCount += s.RequestCount
+		merged.ClientAbortCount += s.ClientAbortCount
+		merged.Requests = append(merged.Requests, s.Requests...)
+
+		if len(s.Requests) == 0 {
+			continue
+		}
+		if start := s.Requests[0].Start; s.FirstMessage != "" && (firstStart.IsZero() || start.Before(firstStart)) {
+			firstStart = start
+			merged.FirstMessage = s.FirstMessage
+		}
+		if end := s.Requests[len(s.Requests)-1].End; s.LastMessage != "" && end.After(lastEnd) {
+			lastEnd = end
+			merged.LastMessage = s.LastMessage
+		}
+	}
+
+	sort.Slice(merged.Requests, func(i, j int) bool {
+		return merged.Requests[i].Start.Before(merged.Requests[j].Start)
+	})
+
+	return merged
+}
+
 type handledRequest struct {
 	startTime     time.Time
 	endTime       time.Time
 	body          []byte
+	messages      []string
 	contentType   string
 	contentLength string
 	statusCode    int
+	proto         string
+	streamID      uint32
+	tls           *tls.ConnectionState
+	requestID     string
+	remoteAddr    string
+	traceContext  *traceContext
+	latency       *time.Duration
+	responseBytes int64
+	abortedAt     *time.Time
 }
 
 type responseWriterWrapper struct {
@@ -162,6 +318,16 @@ func (w *responseWriterWrapper) Write(b []byte) (int, error) {
 	return n, err
 }
 
+func (w *responseWriterWrapper) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (f *responseWriterWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return f.ResponseWriter.(http.Hijacker).Hijack()
+	hj, ok := f.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return hj.Hijack()
 }
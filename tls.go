@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// tlsHandshakeTimeout bounds how long a client has to complete the TLS
+// handshake once connected.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// ephemeralCertificateValidity is how long generated certificates are valid
+// for. They are only meant to last for a test run.
+const ephemeralCertificateValidity = 7 * 24 * time.Hour
+
+type TLSClientAuth string
+
+const (
+	// no client certificate is requested
+	TLSClientAuthNone TLSClientAuth = "NONE"
+
+	// a client certificate is requested and verified if given
+	TLSClientAuthRequest TLSClientAuth = "REQUEST"
+
+	// a valid client certificate is required (mutual TLS)
+	TLSClientAuthRequire TLSClientAuth = "REQUIRE"
+)
+
+type tlsParameters struct {
+	CertFile       *string `json:"cert_file,omitempty"`
+	CAFile         *string `json:"ca_file,omitempty"`
+	ClientAuth     string  `json:"client_auth"`
+	ClientCAFile   *string `json:"client_ca_file,omitempty"`
+	ClientCertFile *string `json:"client_cert_file,omitempty"`
+	ClientKeyFile  *string `json:"client_key_file,omitempty"`
+}
+
+// certificateAuthority is an ephemeral CA generated at startup to issue the
+// certificates of servers not given one, and of clients for mutual TLS. Its
+// certificate and the client certificate are written to dir so clients can
+// use them.
+type certificateAuthority struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	mu         sync.Mutex
+	clientCert *string
+	clientKey  *string
+}
+
+func newCertificateAuthority(dir string) (*certificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template, err := certificateTemplate("http_test_server CA")
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ca := &certificateAuthority{
+		dir:  dir,
+		cert: cert,
+		key:  key,
+	}
+	if err := writePEM(ca.CAFile(), "CERTIFICATE", der); err != nil {
+		return nil, err
+	}
+
+	return ca, nil
+}
+
+func (ca *certificateAuthority) CAFile() string {
+	return filepath.Join(ca.dir, "ca.pem")
+}
+
+func (ca *certificateAuthority) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a certificate signed by the CA for the given DNS names and IP
+// addresses.
+func (ca *certificateAuthority) issue(commonName string, hosts []string, usage x509.ExtKeyUsage) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template, err := certificateTemplate(commonName)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// clientCertificate issues a client certificate, once, and writes it and its
+// key next to the CA certificate. It returns the paths of both.
+func (ca *certificateAuthority) clientCertificate() (string, string, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	if ca.clientCert != nil {
+		return *ca.clientCert, *ca.clientKey, nil
+	}
+
+	cert, err := ca.issue("http_test_server client", nil, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return "", "", err
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	certFile := filepath.Join(ca.dir, "client.pem")
+	keyFile := filepath.Join(ca.dir, "client-key.pem")
+	if err := writePEM(certFile, "CERTIFICATE", cert.Certificate[0]); err != nil {
+		return "", "", err
+	}
+	if err := writePEM(keyFile, "PRIVATE KEY", key); err != nil {
+		return "", "", err
+	}
+
+	ca.clientCert = &certFile
+	ca.clientKey = &keyFile
+	return certFile, keyFile, nil
+}
+
+func certificateTemplate(commonName string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour), // allow for clock skew
+		NotAfter:     now.Add(ephemeralCertificateValidity),
+	}, nil
+}
+
+func writePEM(path string, blockType string, der []byte) error {
+	return ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+}
+
+// buildTLSConfig builds the TLS configuration of the server described by v, or
+// returns nil if TLS is not enabled. Servers not given a certificate use one
+// issued by the ephemeral CA returned by ca, which is only generated if needed.
+func buildTLSConfig(v *viper.Viper, ca func() (*certificateAuthority, error)) (*tls.Config, *tlsParameters, error) {
+	if !v.GetBool("tls.enabled") {
+		return nil, nil, nil
+	}
+
+	config := &tls.Config{
+		NextProtos: []string{"http/1.1"},
+	}
+	parameters := &tlsParameters{}
+
+	certFile := v.GetString("tls.cert-file")
+	keyFile := v.GetString("tls.key-file")
+	var authority *certificateAuthority
+	switch {
+	case certFile != "" && keyFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not load TLS certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+		parameters.CertFile = &certFile
+	case certFile != "" || keyFile != "":
+		return nil, nil, fmt.Errorf("--tls-cert-file and --tls-key-file must be given together")
+	default:
+		var err error
+		authority, err = ca()
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not generate TLS certificate authority: %s", err)
+		}
+
+		cert, err := authority.issue("http_test_server", certificateHosts(v.GetString("address")), x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not generate TLS certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+
+		caFile := authority.CAFile()
+		parameters.CAFile = &caFile
+	}
+
+	clientAuth := TLSClientAuth(v.GetString("tls.client-auth"))
+	parameters.ClientAuth = string(clientAuth)
+	switch clientAuth {
+	case TLSClientAuthNone:
+		config.ClientAuth = tls.NoClientCert
+		return config, parameters, nil
+	case TLSClientAuthRequest:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case TLSClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, nil, fmt.Errorf("unknown tls-client-auth value: %s", clientAuth)
+	}
+
+	if clientCAFile := v.GetString("tls.client-ca-file"); clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read TLS client CA: %s", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("could not read TLS client CA: no certificates found in %s", clientCAFile)
+		}
+		parameters.ClientCAFile = &clientCAFile
+		return config, parameters, nil
+	}
+
+	if authority == nil {
+		return nil, nil, fmt.Errorf("--tls-client-ca-file is required with --tls-cert-file if --tls-client-auth is not NONE")
+	}
+
+	clientCertFile, clientKeyFile, err := authority.clientCertificate()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate TLS client certificate: %s", err)
+	}
+	config.ClientCAs = authority.Pool()
+	caFile := authority.CAFile()
+	parameters.ClientCAFile = &caFile
+	parameters.ClientCertFile = &clientCertFile
+	parameters.ClientKeyFile = &clientKeyFile
+
+	return config, parameters, nil
+}
+
+// certificateHosts returns the names a generated certificate for a server
+// bound to address should be valid for.
+func certificateHosts(address string) []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil {
+		hosts = append(hosts, hostname)
+	}
+	if host, _, err := net.SplitHostPort(address); err == nil && host != "" {
+		if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// tlsListener performs the TLS handshake of accepted connections before
+// handing them to the HTTP server so that handshakes, and their failures,
+// can be recorded.
+type tlsListener struct {
+	net.Listener
+	config     *tls.Config
+	statistics *tlsStatistics
+
+	conns chan net.Conn
+	done  chan struct{}
+	err   error
+}
+
+func newTLSListener(listener net.Listener, config *tls.Config, statistics *tlsStatistics) *tlsListener {
+	l := &tlsListener{
+		Listener:   listener,
+		config:     config,
+		statistics: statistics,
+		conns:      make(chan net.Conn),
+		done:       make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *tlsListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.err = err
+			close(l.done)
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *tlsListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		l.statistics.recordFailure(conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	l.statistics.recordHandshake(tlsConn.ConnectionState())
+
+	select {
+	case l.conns <- tlsConn:
+	case <-l.done:
+		tlsConn.Close()
+	}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	}
+}
+
+type TLSStatistics struct {
+	// successful handshakes by negotiated version and cipher suite
+	Handshakes        map[string]int64       `json:"handshakes"`
+	HandshakeFailures []*TLSHandshakeFailure `json:"handshake_failures"`
+}
+
+type TLSHandshakeFailure struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	Error      string    `json:"error"`
+}
+
+type tlsStatistics struct {
+	mu         sync.Mutex
+	statistics *TLSStatistics
+}
+
+func newTLSStatistics() *tlsStatistics {
+	return &tlsStatistics{
+		statistics: &TLSStatistics{
+			Handshakes:        map[string]int64{},
+			HandshakeFailures: []*TLSHandshakeFailure{},
+		},
+	}
+}
+
+func (ts *tlsStatistics) recordHandshake(state tls.ConnectionState) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.statistics.Handshakes[tlsVersionName(state.Version)+" "+tlsCipherSuiteName(state.CipherSuite)]++
+}
+
+func (ts *tlsStatistics) recordFailure(remoteAddr net.Addr, err error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.statistics.HandshakeFailures = append(ts.statistics.HandshakeFailures, &TLSHandshakeFailure{
+		Time:       time.Now().UTC(),
+		RemoteAddr: remoteAddr.String(),
+		Error:      err.Error(),
+	})
+}
+
+func (ts *tlsStatistics) Statistics() *TLSStatistics {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	statistics := &TLSStatistics{
+		Handshakes:        map[string]int64{},
+		HandshakeFailures: append([]*TLSHandshakeFailure{}, ts.statistics.HandshakeFailures...),
+	}
+	for k, v := range ts.statistics.Handshakes {
+		statistics.Handshakes[k] = v
+	}
+	return statistics
+}
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+var tlsCipherSuiteNames = map[uint16]string{
+	tls.TLS_AES_128_GCM_SHA256:                  "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:                  "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256:            "TLS_CHACHA20_POLY1305_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+}
+
+func tlsCipherSuiteName(id uint16) string {
+	if name, ok := tlsCipherSuiteNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", id)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// traceContext is the W3C trace context a request was sent with, as given by
+// its traceparent and tracestate headers.
+type traceContext struct {
+	TraceID  string
+	ParentID string
+	Flags    string
+	State    string
+}
+
+// parseTraceContext parses the trace context of r. It returns nil if r has
+// no traceparent header or if it is invalid, in which case tracestate is
+// ignored too.
+func parseTraceContext(r *http.Request) *traceContext {
+	tc, err := parseTraceParent(r.Header.Get("traceparent"))
+	if err != nil {
+		return nil
+	}
+
+	// tracestate may be split across several header lines
+	if state := strings.Join(r.Header["Tracestate"], ","); state != "" {
+		tc.State = parseTraceState(state)
+	}
+
+	return tc
+}
+
+// parseTraceParent parses a traceparent header value:
+// version-trace_id-parent_id-flags, in lowercase hex.
+func parseTraceParent(value string) (*traceContext, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, fmt.Errorf("no traceparent")
+	}
+
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("traceparent has %d fields, expected 4", len(parts))
+	}
+
+	version := parts[0]
+	if !isLowerHex(version, 2) || version == "ff" {
+		return nil, fmt.Errorf("invalid traceparent version: %s", version)
+	}
+	// later versions may add fields, but only after the ones of version 00
+	if version == "00" && len(parts) != 4 {
+		return nil, fmt.Errorf("traceparent has %d fields, expected 4", len(parts))
+	}
+
+	traceID, parentID, flags := parts[1], parts[2], parts[3]
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return nil, fmt.Errorf("invalid trace ID: %s", traceID)
+	}
+	if !isLowerHex(parentID, 16) || parentID == strings.Repeat("0", 16) {
+		return nil, fmt.Errorf("invalid parent ID: %s", parentID)
+	}
+	if !isLowerHex(flags, 2) {
+		return nil, fmt.Errorf("invalid trace flags: %s", flags)
+	}
+
+	return &traceContext{
+		TraceID:  traceID,
+		ParentID: parentID,
+		Flags:    flags,
+	}, nil
+}
+
+// maxTraceStateMembers is the number of list members tracestate may carry.
+const maxTraceStateMembers = 32
+
+// parseTraceState returns the list members of a tracestate header value,
+// dropping empty and malformed ones. The whole value is dropped if it has too
+// many members or a key more than once.
+func parseTraceState(value string) string {
+	members := []string{}
+	keys := map[string]bool{}
+	for _, member := range strings.Split(value, ",") {
+		member = strings.TrimSpace(member)
+		if member == "" {
+			continue
+		}
+
+		i := strings.Index(member, "=")
+		if i <= 0 || i == len(member)-1 {
+			continue
+		}
+		key := member[:i]
+		if keys[key] {
+			return ""
+		}
+		keys[key] = true
+
+		members = append(members, member)
+	}
+
+	if len(members) > maxTraceStateMembers {
+		return ""
+	}
+	return strings.Join(members, ",")
+}
+
+func isLowerHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDs counts the requests of all servers of the process, so that
+// their IDs are unique across them.
+var requestIDs uint64
+
+// requestIDPrefix tells apart the request IDs of separate runs.
+var requestIDPrefix = fmt.Sprintf("%x", time.Now().UnixNano())
+
+// nextRequestID returns a new request ID, unique within the process and
+// increasing with each request.
+func nextRequestID() string {
+	return fmt.Sprintf("%s-%d", requestIDPrefix, atomic.AddUint64(&requestIDs, 1))
+}
+
+// requestTraceContext returns the trace context r was sent with, if any.
+func requestTraceContext(r *http.Request) *traceContext {
+	tc, _ := r.Context().Value(traceContextKey).(*traceContext)
+	return tc
+}
+
+// requestID returns the ID of r, as given by its X-Request-Id header or
+// generated for it.
+func requestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDKey).(string)
+	return id
+}
+
+func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestID := r.Header.Get("X-Request-Id")
+			if requestID == "" {
+				requestID = nextRequestID()
+			}
+			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+			if tc := parseTraceContext(r); tc != nil {
+				ctx = context.WithValue(ctx, traceContextKey, tc)
+			}
+			w.Header().Set("X-Request-Id", requestID)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	const (
+		traceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentID = "00f067aa0ba902b7"
+	)
+
+	tests := []struct {
+		name  string
+		value string
+		want  *traceContext
+	}{
+		{name: "valid", value: "00-" + traceID + "-" + parentID + "-01", want: &traceContext{TraceID: traceID, ParentID: parentID, Flags: "01"}},
+		{name: "not sampled", value: "00-" + traceID + "-" + parentID + "-00", want: &traceContext{TraceID: traceID, ParentID: parentID, Flags: "00"}},
+		{name: "surrounding whitespace", value: " 00-" + traceID + "-" + parentID + "-01\t", want: &traceContext{TraceID: traceID, ParentID: parentID, Flags: "01"}},
+		{name: "later version", value: "01-" + traceID + "-" + parentID + "-01", want: &traceContext{TraceID: traceID, ParentID: parentID, Flags: "01"}},
+		{name: "later version with more fields", value: "01-" + traceID + "-" + parentID + "-01-what-the-future", want: &traceContext{TraceID: traceID, ParentID: parentID, Flags: "01"}},
+		{name: "empty", value: ""},
+		{name: "too few fields", value: "00-" + traceID + "-" + parentID},
+		{name: "version 00 with more fields", value: "00-" + traceID + "-" + parentID + "-01-extra"},
+		{name: "invalid version", value: "ff-" + traceID + "-" + parentID + "-01"},
+		{name: "short version", value: "0-" + traceID + "-" + parentID + "-01"},
+		{name: "uppercase trace ID", value: "00-" + strings.ToUpper(traceID) + "-" + parentID + "-01"},
+		{name: "short trace ID", value: "00-" + traceID[1:] + "-" + parentID + "-01"},
+		{name: "zero trace ID", value: "00-" + strings.Repeat("0", 32) + "-" + parentID + "-01"},
+		{name: "non hex parent ID", value: "00-" + traceID + "-00f067aa0ba902bz-01"},
+		{name: "zero parent ID", value: "00-" + traceID + "-" + strings.Repeat("0", 16) + "-01"},
+		{name: "long flags", value: "00-" + traceID + "-" + parentID + "-001"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc, err := parseTraceParent(tt.value)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("got trace context %+v, want an error", tc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got error %s", err)
+			}
+			if *tc != *tt.want {
+				t.Fatalf("got trace context %+v, want %+v", tc, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTraceState(t *testing.T) {
+	many := make([]string, maxTraceStateMembers+1)
+	for i := range many {
+		many[i] = "k" + strings.Repeat("x", i) + "=v"
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{name: "single member", value: "congo=t61rcWkgMzE", want: "congo=t61rcWkgMzE"},
+		{name: "several members", value: "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE", want: "rojo=00f067aa0ba902b7,congo=t61rcWkgMzE"},
+		{name: "whitespace", value: " rojo=1 ,\tcongo=2 ", want: "rojo=1,congo=2"},
+		{name: "empty members", value: "rojo=1,,  ,congo=2", want: "rojo=1,congo=2"},
+		{name: "member without value", value: "rojo=,congo=2", want: "congo=2"},
+		{name: "member without key", value: "=1,congo=2", want: "congo=2"},
+		{name: "member without equals", value: "rojo,congo=2", want: "congo=2"},
+		{name: "duplicate key", value: "rojo=1,congo=2,rojo=3", want: ""},
+		{name: "as many members as allowed", value: strings.Join(many[:maxTraceStateMembers], ","), want: strings.Join(many[:maxTraceStateMembers], ",")},
+		{name: "too many members", value: strings.Join(many, ","), want: ""},
+		{name: "empty", value: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseTraceState(tt.value); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTraceContext(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	tests := []struct {
+		name        string
+		traceParent string
+		traceState  []string
+		want        *traceContext
+	}{
+		{name: "no headers"},
+		{name: "tracestate alone", traceState: []string{"rojo=1"}},
+		{name: "invalid traceparent", traceParent: "garbage", traceState: []string{"rojo=1"}},
+		{
+			name:        "traceparent alone",
+			traceParent: traceParent,
+			want:        &traceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7", Flags: "01"},
+		},
+		{
+			name:        "tracestate split across lines",
+			traceParent: traceParent,
+			traceState:  []string{"rojo=1", "congo=2"},
+			want:        &traceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7", Flags: "01", State: "rojo=1,congo=2"},
+		},
+		{
+			name:        "duplicate key across lines",
+			traceParent: traceParent,
+			traceState:  []string{"rojo=1", "rojo=2"},
+			want:        &traceContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", ParentID: "00f067aa0ba902b7", Flags: "01"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.traceParent != "" {
+				r.Header.Set("traceparent", tt.traceParent)
+			}
+			for _, state := range tt.traceState {
+				r.Header.Add("tracestate", state)
+			}
+
+			tc := parseTraceContext(r)
+			switch {
+			case tt.want == nil && tc != nil:
+				t.Fatalf("got trace context %+v, want none", tc)
+			case tt.want != nil && (tc == nil || *tc != *tt.want):
+				t.Fatalf("got trace context %+v, want %+v", tc, tt.want)
+			}
+		})
+	}
+}
+
+func TestTracingRequestID(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "generated", want: "generated"},
+		{name: "given", header: "abc-123", want: "abc-123"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := tracing(func() string { return "generated" })(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = requestID(r)
+			}))
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				r.Header.Set("X-Request-Id", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if got != tt.want || w.Header().Get("X-Request-Id") != tt.want {
+				t.Fatalf("got request ID %q, header %q, want %q", got, w.Header().Get("X-Request-Id"), tt.want)
+			}
+		})
+	}
+}
+
+func TestNextRequestID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := nextRequestID()
+		if !strings.HasPrefix(id, requestIDPrefix+"-") {
+			t.Fatalf("request ID %s does not start with %s-", id, requestIDPrefix)
+		}
+		if seen[id] {
+			t.Fatalf("request ID %s generated twice", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var validateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Check the configuration and trial-evaluate every expression.",
+	Long: `Check the configuration and trial-evaluate every expression.
+
+All flags, environment variables and the config file are parsed and every
+expression is compiled, as when starting the server. Each expression is then
+evaluated over a grid of active_requests and t values to catch type errors,
+negative latencies, invalid status codes and unknown variables that would
+otherwise only show up as failed requests during a run.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		grid := expressionGrid{}
+		grid.activeRequests, _ = cmd.Flags().GetUintSlice("active-requests")
+		grid.t, _ = cmd.Flags().GetDurationSlice("t")
+		grid.samples, _ = cmd.Flags().GetInt("samples")
+
+		problems := []string{}
+		err := eachProfile(viper.GetViper(), func(location profileLocation, serverOptions ServerOptions) {
+			problems = append(problems, grid.check(location.String(), serverOptions)...)
+		})
+		if err != nil {
+			return err
+		}
+
+		names, configs, err := serverConfigs(viper.GetViper())
+		if err != nil {
+			return err
+		}
+
+		// servers are built as when starting them, without binding their
+		// listeners, with a certificate authority thrown away afterwards
+		dir, err := ioutil.TempDir("", "http_test_server")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		var authority *certificateAuthority
+		ca := func() (*certificateAuthority, error) {
+			if authority == nil {
+				authority, err = newCertificateAuthority(dir)
+			}
+			return authority, err
+		}
+
+		for i, name := range names {
+			location := "health"
+			if name != "" {
+				location = fmt.Sprintf("server %s, health", name)
+			}
+
+			health, _, err := buildHealth(configs[i])
+			if err != nil {
+				return fmt.Errorf("%s: %s", location, err)
+			}
+			problems = append(problems, grid.check(location, ServerOptions{Health: *health})...)
+
+			if _, _, err := buildVirtualServerOptions(name, configs[i], ca); err != nil {
+				return err
+			}
+		}
+
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("found %d problem(s)", len(problems))
+		}
+
+		fmt.Println("Configuration is valid")
+		return nil
+	},
+}
+
+// profileLocation identifies a profile within the configuration. server is
+// empty unless virtual servers are declared and phase is empty for the
+// profile of the route itself.
+type profileLocation struct {
+	server, route, phase string
+}
+
+func (l profileLocation) String() string {
+	s := fmt.Sprintf("route %s", l.route)
+	if l.server != "" {
+		s = fmt.Sprintf("server %s, %s", l.server, s)
+	}
+	if l.phase != "" {
+		s = fmt.Sprintf("%s, phase %s", s, l.phase)
+	}
+	return s
+}
+
+// eachProfile builds the options of every server described by v and calls f
+// with the resolved options of each of their routes and phases.
+func eachProfile(v *viper.Viper, f func(location profileLocation, serverOptions ServerOptions)) error {
+	names, configs, err := serverConfigs(v)
+	if err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		opts, _, err := buildServerOptions(configs[i])
+		if err != nil {
+			if name != "" {
+				return fmt.Errorf("server %s: %s", name, err)
+			}
+			return err
+		}
+
+		for _, route := range routes(opts) {
+			serverOptions := resolveOptions(route.Options)
+			f(profileLocation{server: name, route: route.Path}, serverOptions)
+
+			for _, phase := range serverOptions.Phases {
+				f(profileLocation{server: name, route: route.Path, phase: phase.Name}, resolveOptions(phase.Options))
+			}
+		}
+	}
+
+	return nil
+}
+
+// expressionGrid is the set of points at which expressions are evaluated.
+// Each point is sampled several times to account for rand().
+type expressionGrid struct {
+	activeRequests []uint
+	t              []time.Duration
+	samples        int
+}
+
+// eachPoint calls f with the expression parameters of every point of the
+// grid.
+func (g expressionGrid) eachPoint(f func(parameters *expressionParameters)) {
+	for _, t := range g.t {
+		for _, activeRequests := range g.activeRequests {
+			f(&expressionParameters{
+				activeRequests: uint32(activeRequests),
+				t:              t,
+			})
+		}
+	}
+}
+
+// each calls f with the expression parameters of every point of the grid, as
+// many times as there are samples.
+func (g expressionGrid) each(f func(parameters *expressionParameters)) {
+	g.eachPoint(func(parameters *expressionParameters) {
+		for i := 0; i < g.samples; i++ {
+			f(parameters)
+		}
+	})
+}
+
+// check returns the problems found with the expressions of serverOptions.
+// Each distinct problem is reported once, at the first point it occurs.
+func (g expressionGrid) check(location string, serverOptions ServerOptions) []string {
+	found := map[string]*expressionParameters{}
+	report := func(problem string, parameters *expressionParameters) {
+		if _, ok := found[problem]; !ok {
+			found[problem] = parameters
+		}
+	}
+
+	if lm, ok := serverOptions.Latency.(*LatencyMiddlewareExpression); ok {
+		if err := checkVariables(lm.mean, expressionVariables); err != nil {
+			report(fmt.Sprintf("latency mean expression: %s", err), nil)
+		}
+		if err := checkVariables(lm.stddev, expressionVariables); err != nil {
+			report(fmt.Sprintf("latency stddev expression: %s", err), nil)
+		}
+
+		g.each(func(parameters *expressionParameters) {
+			mean, stddev, err := lm.evaluate(parameters)
+			switch {
+			case err != nil:
+				report(fmt.Sprintf("latency expression: %s", err), parameters)
+			case mean < 0:
+				report("latency mean expression: returned a negative latency", parameters)
+			case stddev < 0:
+				report("latency stddev expression: returned a negative standard deviation", parameters)
+			}
+		})
+	}
+
+	if em, ok := serverOptions.Error.(*ErrorExpressionMiddleware); ok {
+		if err := checkVariables(em.expr, expressionVariables); err != nil {
+			report(fmt.Sprintf("error expression: %s", err), nil)
+		}
+
+		g.each(func(parameters *expressionParameters) {
+			if _, err := em.evaluate(parameters); err != nil {
+				report(fmt.Sprintf("error expression: %s", err), parameters)
+			}
+		})
+	}
+
+	if serverOptions.Health.Expression != nil {
+		g.each(func(parameters *expressionParameters) {
+			if _, err := serverOptions.Health.evaluate(parameters); err != nil {
+				report(err.Error(), parameters)
+			}
+		})
+	}
+
+	problems := []string{}
+	for problem, parameters := range found {
+		if parameters != nil {
+			problem = fmt.Sprintf("%s (at active_requests=%d, t=%s)", problem, parameters.activeRequests, parameters.t)
+		}
+		problems = append(problems, fmt.Sprintf("%s: %s", location, problem))
+	}
+	sort.Strings(problems)
+	return problems
+}